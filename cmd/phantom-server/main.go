@@ -2,16 +2,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/anthropics/phantom-server/internal/admin"
 	"github.com/anthropics/phantom-server/internal/crypto"
 	"github.com/anthropics/phantom-server/internal/handler"
+	"github.com/anthropics/phantom-server/internal/protocol"
 	"github.com/anthropics/phantom-server/internal/transport"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
@@ -24,14 +35,54 @@ var (
 type Config struct {
 	Listen     string `yaml:"listen"`
 	PSK        string `yaml:"psk"`
+	PSKFile    string `yaml:"psk_file"`
 	TimeWindow int    `yaml:"time_window"`
+	Cipher     string `yaml:"cipher"`
 	LogLevel   string `yaml:"log_level"`
+	Admin      string `yaml:"admin"`
+
+	WindowSlack     int `yaml:"window_slack"`
+	ClockSkewPast   int `yaml:"clock_skew_past"`
+	ClockSkewFuture int `yaml:"clock_skew_future"`
+	NonceCacheSize  int `yaml:"nonce_cache_size"`
+
+	MaxConnLifetime int  `yaml:"max_conn_lifetime"`
+	MaxConns        int  `yaml:"max_conns"`
+	MemoryBudgetMB  int  `yaml:"memory_budget_mb"`
+	MaxFrameRate    int  `yaml:"max_frame_rate"`
+	UnknownLimit    int  `yaml:"unknown_type_limit"`
+	WriteTimeout    int  `yaml:"write_timeout"`
+	FrameTimeout    int  `yaml:"frame_timeout"`
+	FlowWindow      int  `yaml:"flow_window"`
+	AccessLog       bool `yaml:"access_log"`
+	Compression     bool `yaml:"compression"`
+	NoDelay         bool `yaml:"no_delay"`
+	CryptoFailFast  bool `yaml:"crypto_fail_fast"`
+
+	AllowedNetworks []string `yaml:"allowed_networks"`
+	ProbeDecoy      string   `yaml:"probe_decoy"`
+	SelfAddrs       []string `yaml:"self_addrs"`
+	Upstream        string   `yaml:"upstream"`
+	DNSServer       string   `yaml:"dns_server"`
+	UDPSourcePorts  []int    `yaml:"udp_source_ports"`
+
+	// 路由规则引用 upstreams 中的名称作为出口
+	Upstreams map[string]string `yaml:"upstreams"`
+	Routes    []handler.Route   `yaml:"routes"`
 }
 
 func main() {
-	configPath := flag.String("c", "config.yaml", "配置文件路径")
+	configPath := flag.String("c", "config.yaml", "配置文件路径，- 表示 stdin，也可以是 https:// URL")
 	showVersion := flag.Bool("v", false, "显示版本")
 	genPSK := flag.Bool("gen-psk", false, "生成新的 PSK")
+	validate := flag.Bool("validate", false, "校验配置文件后退出，不启动服务")
+	quiet := flag.Bool("quiet", false, "不输出启动横幅")
+	jsonOutput := flag.Bool("json", false, "启动后输出一行 JSON 描述运行信息，代替横幅")
+	askPSK := flag.Bool("ask-psk", false, "从终端读取 PSK (不回显)，代替配置文件中的 psk")
+	selftest := flag.Bool("selftest", false, "在进程内自检各子系统后退出，不需要配置文件")
+	replayPath := flag.String("replay", "", "离线解码抓取的帧序列文件 (一个方向的原始 TCP 流) 后退出，使用配置文件中的 psk")
+	replayTime := flag.String("replay-time", "", "抓包开始的大致时间 (RFC 3339)，默认为当前时间")
+	gracefulRestart := flag.Bool("graceful-restart", false, "收到 SIGUSR2 时以相同参数启动新进程并交接监听端口，本进程排空现有连接后退出 (仅 Unix)")
 	flag.Parse()
 
 	if *showVersion {
@@ -42,71 +93,531 @@ func main() {
 	}
 
 	if *genPSK {
-		psk, _ := crypto.GeneratePSK()
+		psk, err := crypto.GeneratePSK()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		fmt.Println(psk)
 		return
 	}
 
-	cfg, err := loadConfig(*configPath)
+	if *selftest {
+		fmt.Printf("Phantom Server v%s 自检:\n", Version)
+		if !printSelfTest(os.Stdout, runSelfTest()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *validate {
+		if err := validateConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "配置无效: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("配置有效: %s\n", *configPath)
+		return
+	}
+
+	if *gracefulRestart {
+		switch {
+		case restartSignal == nil:
+			fmt.Fprintln(os.Stderr, "当前平台不支持 -graceful-restart")
+			os.Exit(1)
+		case *configPath == "-" || *askPSK:
+			// 新进程需要重新读取配置
+			fmt.Fprintln(os.Stderr, "-graceful-restart 不能与从 stdin 读取配置或 -ask-psk 同时使用")
+			os.Exit(1)
+		}
+	}
+
+	var overrides []configOverride
+	if *askPSK {
+		if *configPath == "-" {
+			fmt.Fprintln(os.Stderr, "-ask-psk 不能与从 stdin 读取配置同时使用")
+			os.Exit(1)
+		}
+		psk, err := promptPSK()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取 PSK 失败: %v\n", err)
+			os.Exit(1)
+		}
+		overrides = append(overrides, func(cfg *Config) { cfg.PSK = psk })
+	}
+
+	cfg, err := loadConfig(*configPath, overrides...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "配置错误: %v\n", err)
 		os.Exit(1)
 	}
 
-	cry, err := crypto.New(cfg.PSK, cfg.TimeWindow)
+	if *replayPath != "" {
+		if err := runReplay(*replayPath, *replayTime, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "解码失败: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	suite, _ := crypto.ParseCipher(cfg.Cipher) // loadConfig 已校验
+	cryptoOpts := []crypto.Option{
+		crypto.WithCipher(suite),
+		crypto.WithWindowSlack(cfg.WindowSlack),
+		crypto.WithTimestampTolerance(
+			time.Duration(cfg.ClockSkewPast)*time.Second,
+			time.Duration(cfg.ClockSkewFuture)*time.Second),
+	}
+	if cfg.NonceCacheSize > 0 {
+		cryptoOpts = append(cryptoOpts, crypto.WithRecvNonceCacheSize(cfg.NonceCacheSize))
+	}
+	cry, err := crypto.New(cfg.PSK, cfg.TimeWindow, cryptoOpts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "加密模块错误: %v\n", err)
 		os.Exit(1)
 	}
 
-	tcpHandler := handler.NewTCPHandler(cry, cfg.LogLevel)
+	handlerOpts := []handler.Option{
+		handler.WithMaxConnLifetime(time.Duration(cfg.MaxConnLifetime) * time.Second),
+		handler.WithMaxConns(cfg.MaxConns),
+		handler.WithMemoryBudget(int64(cfg.MemoryBudgetMB) << 20),
+		handler.WithFrameRateLimit(cfg.MaxFrameRate),
+		handler.WithUnknownTypeLimit(cfg.UnknownLimit),
+		handler.WithAccessLog(cfg.AccessLog),
+		handler.WithCompression(cfg.Compression),
+		handler.WithCryptoFailFast(cfg.CryptoFailFast),
+		handler.WithWriteTimeout(time.Duration(cfg.WriteTimeout) * time.Second),
+		handler.WithFrameTimeout(time.Duration(cfg.FrameTimeout) * time.Second),
+		handler.WithFlowControl(cfg.FlowWindow),
+		handler.WithProbeDecoy(cfg.ProbeDecoy),
+		// 监听地址总是视为自身，防止目标指回本机形成代理环路
+		handler.WithSelfAddrs(append([]string{cfg.Listen}, cfg.SelfAddrs...)...),
+	}
+	if len(cfg.AllowedNetworks) > 0 {
+		networks, _ := parseNetworks(cfg.AllowedNetworks)
+		handlerOpts = append(handlerOpts, handler.WithAllowedNetworks(networks...))
+	}
+	if cfg.Upstream != "" {
+		up, _ := handler.ParseUpstream(cfg.Upstream)
+		handlerOpts = append(handlerOpts, handler.WithUpstream(up))
+	}
+	if len(cfg.Routes) > 0 {
+		router, _ := handler.NewRouter(cfg.Routes, cfg.Upstreams)
+		handlerOpts = append(handlerOpts, handler.WithRouter(router))
+	}
+	if cfg.DNSServer != "" {
+		r, _ := handler.ParseResolver(cfg.DNSServer)
+		handlerOpts = append(handlerOpts, handler.WithResolver(r))
+	}
+	if len(cfg.UDPSourcePorts) == 2 {
+		handlerOpts = append(handlerOpts, handler.WithUDPSourcePorts(cfg.UDPSourcePorts[0], cfg.UDPSourcePorts[1]))
+	}
+	tcpHandler := handler.NewTCPHandler(cry, cfg.LogLevel, handlerOpts...)
 	srv := transport.NewTCPServer(cfg.Listen, tcpHandler, cfg.LogLevel)
+	srv.SetNoDelay(cfg.NoDelay)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := srv.Start(ctx); err != nil {
+	// 由平滑重启启动时接管父进程的监听套接字
+	listener, err := inheritedListener()
+	if err == nil {
+		if listener != nil {
+			err = srv.Serve(ctx, listener)
+		} else {
+			err = srv.Start(ctx)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "启动失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	var adminSrv *admin.Server
+	startAdmin := func() error {
+		if cfg.Admin == "" {
+			return nil
+		}
+		adminSrv = admin.New(cfg.Admin, tcpHandler, srv)
+		return adminSrv.Start()
+	}
+	if err := startAdmin(); err != nil {
 		fmt.Fprintf(os.Stderr, "启动失败: %v\n", err)
+		srv.Stop()
 		os.Exit(1)
 	}
+	notifyReady()
+	startTime := time.Now()
 
-	printBanner(cfg)
+	switch {
+	case *jsonOutput:
+		info := newStartupInfo(cfg, srv.Addr().String())
+		if adminSrv != nil {
+			info.Admin = adminSrv.Addr().String()
+		}
+		if err := printStartupJSON(os.Stdout, info); err != nil {
+			fmt.Fprintf(os.Stderr, "输出启动信息失败: %v\n", err)
+		}
+	case !*quiet:
+		printBanner(cfg)
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	if *gracefulRestart {
+		signal.Notify(sigCh, restartSignal)
+	}
+	for sig := range sigCh {
+		if sig != restartSignal {
+			break
+		}
+		// 管理接口的地址无法共享，先释放给新进程；新进程失败时重新启动
+		if adminSrv != nil {
+			adminSrv.Stop()
+			adminSrv = nil
+		}
+		err := startSuccessor(srv)
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "平滑重启失败，继续运行: %v\n", err)
+		if err := startAdmin(); err != nil {
+			fmt.Fprintf(os.Stderr, "重新启动管理接口失败: %v\n", err)
+		}
+	}
 
 	fmt.Println("\n正在关闭...")
+	srv.StopGraceful(shutdownTimeout)
 	cancel()
-	srv.Stop()
+	if adminSrv != nil {
+		adminSrv.Stop()
+	}
+
+	summary := newShutdownSummary(time.Since(startTime), srv.Stats(), tcpHandler.Stats())
+	if err := printShutdownSummary(os.Stdout, summary, *jsonOutput); err != nil {
+		fmt.Fprintf(os.Stderr, "输出运行摘要失败: %v\n", err)
+	}
+}
+
+// shutdownTimeout 优雅停止时等待客户端自行断开的最长时间
+const shutdownTimeout = 5 * time.Second
+
+// maxConfigSize 从 stdin 或 URL 读取配置时的大小上限
+const maxConfigSize = 1 << 20
+
+var (
+	// configStdin 与 configHTTPClient 便于测试替换
+	configStdin      io.Reader = os.Stdin
+	configHTTPClient           = &http.Client{Timeout: 10 * time.Second}
+)
+
+// readConfigSource 读取配置内容
+// path 为 "-" 时从 stdin 读取，为 https:// URL 时通过网络获取，否则读取本地文件
+func readConfigSource(path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		return readLimited(configStdin)
+
+	case strings.HasPrefix(path, "https://"):
+		resp, err := configHTTPClient.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("HTTP 状态码 %d", resp.StatusCode)
+		}
+		return readLimited(resp.Body)
+
+	case strings.HasPrefix(path, "http://"):
+		return nil, fmt.Errorf("远程配置必须使用 https")
+
+	default:
+		return os.ReadFile(path)
+	}
+}
+
+// promptPSK 从终端读取 PSK，关闭回显；stdin 不是终端时 (如管道) 读取一行
+func promptPSK() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readPSK(os.Stdin)
+	}
+
+	fmt.Fprint(os.Stderr, "PSK: ")
+	line, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return readPSK(bytes.NewReader(line))
+}
+
+// readPSK 读取一行 PSK 并校验能解码为 32 字节
+func readPSK(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(io.LimitReader(r, 1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	psk := strings.TrimSpace(line)
+	if psk == "" {
+		return "", fmt.Errorf("PSK 为空")
+	}
+	if err := crypto.ValidatePSK(psk); err != nil {
+		return "", err
+	}
+	return psk, nil
 }
 
-func loadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxConfigSize {
+		return nil, fmt.Errorf("配置超过 %d 字节", maxConfigSize)
+	}
+	return data, nil
+}
+
+// pskEnv 提供 PSK 的环境变量，优先于配置文件中的 psk_file 与 psk
+const pskEnv = "PHANTOM_PSK"
+
+// resolvePSK 按 环境变量 > psk_file > psk 的优先级确定 PSK，避免把密钥写进配置文件
+func resolvePSK(cfg *Config) error {
+	if value := os.Getenv(pskEnv); value != "" {
+		psk, err := readPSK(strings.NewReader(value))
+		if err != nil {
+			return fmt.Errorf("环境变量 %s: %w", pskEnv, err)
+		}
+		cfg.PSK = psk
+		return nil
+	}
+	if cfg.PSKFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(cfg.PSKFile)
+	if err != nil {
+		return fmt.Errorf("psk_file: %w", err)
+	}
+	defer f.Close()
+	psk, err := readPSK(f)
+	if err != nil {
+		return fmt.Errorf("psk_file %s: %w", cfg.PSKFile, err)
+	}
+	cfg.PSK = psk
+	return nil
+}
+
+// configOverride 在解析配置文件之后、校验之前修改配置，用于命令行提供的值
+type configOverride func(*Config)
+
+func loadConfig(path string, overrides ...configOverride) (*Config, error) {
+	data, err := readConfigSource(path)
 	if err != nil {
 		return nil, fmt.Errorf("读取失败: %w", err)
 	}
 
 	cfg := &Config{
-		Listen:     ":54321",
-		TimeWindow: 30,
-		LogLevel:   "info",
+		Listen:      ":54321",
+		TimeWindow:  30,
+		WindowSlack: crypto.WindowSlack,
+		LogLevel:    "info",
+		NoDelay:     true,
 	}
 
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("解析失败: %w", err)
 	}
+	if err := resolvePSK(cfg); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		override(cfg)
+	}
 
 	if cfg.PSK == "" {
-		return nil, fmt.Errorf("psk 不能为空")
+		return nil, fmt.Errorf("psk 不能为空 (也可以用 psk_file 或环境变量 %s 提供)", pskEnv)
+	}
+	if _, err := crypto.ParseCipher(cfg.Cipher); err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+	if cfg.MaxConnLifetime < 0 {
+		return nil, fmt.Errorf("max_conn_lifetime 不能为负数")
+	}
+	if cfg.MaxConns < 0 {
+		return nil, fmt.Errorf("max_conns 不能为负数")
+	}
+	if cfg.MemoryBudgetMB < 0 {
+		return nil, fmt.Errorf("memory_budget_mb 不能为负数")
+	}
+	if cfg.MaxFrameRate < 0 {
+		return nil, fmt.Errorf("max_frame_rate 不能为负数")
+	}
+	if cfg.UnknownLimit < 0 {
+		return nil, fmt.Errorf("unknown_type_limit 不能为负数")
+	}
+	if cfg.WriteTimeout < 0 {
+		return nil, fmt.Errorf("write_timeout 不能为负数")
+	}
+	if cfg.FrameTimeout < 0 {
+		return nil, fmt.Errorf("frame_timeout 不能为负数")
+	}
+	if cfg.FlowWindow < 0 {
+		return nil, fmt.Errorf("flow_window 不能为负数")
+	}
+	if _, err := parseNetworks(cfg.AllowedNetworks); err != nil {
+		return nil, fmt.Errorf("allowed_networks: %w", err)
+	}
+	if err := handler.ValidateDecoyMode(cfg.ProbeDecoy); err != nil {
+		return nil, fmt.Errorf("probe_decoy: %w", err)
+	}
+	if err := handler.ValidateSelfAddrs(cfg.SelfAddrs); err != nil {
+		return nil, fmt.Errorf("self_addrs: %w", err)
+	}
+	if cfg.Upstream != "" {
+		if _, err := handler.ParseUpstream(cfg.Upstream); err != nil {
+			return nil, fmt.Errorf("upstream: %w", err)
+		}
+	}
+	if _, err := handler.NewRouter(cfg.Routes, cfg.Upstreams); err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	if cfg.DNSServer != "" {
+		if _, err := handler.ParseResolver(cfg.DNSServer); err != nil {
+			return nil, fmt.Errorf("dns_server: %w", err)
+		}
+	}
+	if ports := cfg.UDPSourcePorts; len(ports) > 0 {
+		if len(ports) != 2 || ports[0] < 1 || ports[0] > ports[1] || ports[1] > 65535 {
+			return nil, fmt.Errorf("udp_source_ports 应为 [起始端口, 结束端口]，范围 1-65535: %v", ports)
+		}
+	}
+	if err := crypto.ValidateTimeWindow(cfg.TimeWindow, cfg.WindowSlack); err != nil {
+		return nil, fmt.Errorf("time_window/window_slack: %w", err)
+	}
+	if err := crypto.ValidateTimestampTolerance(cfg.TimeWindow, cfg.WindowSlack,
+		time.Duration(cfg.ClockSkewPast)*time.Second, time.Duration(cfg.ClockSkewFuture)*time.Second); err != nil {
+		return nil, fmt.Errorf("clock_skew_past/clock_skew_future: %w", err)
 	}
-	if cfg.TimeWindow < 1 || cfg.TimeWindow > 300 {
-		return nil, fmt.Errorf("time_window 需在 1-300 之间")
+	if cfg.NonceCacheSize < 0 {
+		return nil, fmt.Errorf("nonce_cache_size 不能为负数: %d", cfg.NonceCacheSize)
 	}
 
 	return cfg, nil
 }
 
+func parseNetworks(names []string) ([]byte, error) {
+	networks := make([]byte, 0, len(names))
+	for _, name := range names {
+		n, err := protocol.ParseNetwork(name)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// validateConfig 完整校验配置，但不监听端口也不启动任何协程
+func validateConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := crypto.ValidatePSK(cfg.PSK); err != nil {
+		return err
+	}
+	if _, err := net.ResolveTCPAddr("tcp", cfg.Listen); err != nil {
+		return fmt.Errorf("listen 地址无效: %w", err)
+	}
+	if cfg.Admin != "" {
+		if path, ok := strings.CutPrefix(cfg.Admin, admin.UnixPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("admin 地址无效: Unix socket 路径为空")
+			}
+		} else if _, _, err := net.SplitHostPort(cfg.Admin); err != nil {
+			return fmt.Errorf("admin 地址无效: %w", err)
+		}
+	}
+	return nil
+}
+
+// startupInfo -json 模式下输出的启动信息，供编排工具解析
+type startupInfo struct {
+	Version  string   `json:"version"`
+	Build    string   `json:"build"`
+	Commit   string   `json:"commit"`
+	Listen   []string `json:"listen"`
+	Admin    string   `json:"admin,omitempty"`
+	Features []string `json:"features"`
+}
+
+func newStartupInfo(cfg *Config, listen string) startupInfo {
+	suite, _ := crypto.ParseCipher(cfg.Cipher)
+	features := []string{"tcp", "tskd", suite.String()}
+	if cfg.Compression {
+		features = append(features, "compression")
+	}
+	if cfg.AccessLog {
+		features = append(features, "access_log")
+	}
+	if cfg.FlowWindow > 0 {
+		features = append(features, "flow_control")
+	}
+	if cfg.ProbeDecoy != "" {
+		features = append(features, "probe_decoy:"+cfg.ProbeDecoy)
+	}
+	return startupInfo{
+		Version:  Version,
+		Build:    BuildTime,
+		Commit:   GitCommit,
+		Listen:   []string{listen},
+		Features: features,
+	}
+}
+
+// printStartupJSON 以单行 JSON 输出启动信息
+func printStartupJSON(w io.Writer, info startupInfo) error {
+	return json.NewEncoder(w).Encode(info)
+}
+
+// shutdownSummary 退出时输出的运行摘要，汇总各子系统的统计
+type shutdownSummary struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	ClientConns   int64 `json:"client_conns"`   // 接受的客户端连接
+	ProxyConns    int64 `json:"proxy_conns"`    // 建立的代理连接
+	ConnectFailed int64 `json:"connect_failed"` // 连接目标失败
+	BytesUp       int64 `json:"bytes_up"`       // 客户端 -> 目标
+	BytesDown     int64 `json:"bytes_down"`     // 目标 -> 客户端
+	Dropped       int64 `json:"dropped"`        // 丢弃的帧与消息: 解密失败、未知类型、加密失败
+	DecryptFailed int64 `json:"decrypt_failed"`
+}
+
+func newShutdownSummary(uptime time.Duration, server transport.ServerStats, h handler.Stats) shutdownSummary {
+	return shutdownSummary{
+		UptimeSeconds: int64(uptime / time.Second),
+		ClientConns:   server.TotalConns,
+		ProxyConns:    h.TotalConns,
+		ConnectFailed: h.ConnectFailed,
+		BytesUp:       h.BytesToTarget,
+		BytesDown:     h.BytesFromTarget,
+		Dropped:       h.DecryptFailed + h.UnknownFrames + h.EncryptFailed,
+		DecryptFailed: h.DecryptFailed,
+	}
+}
+
+// printShutdownSummary 输出运行摘要，asJSON 时为单行 JSON (与 -json 的启动信息对应)
+func printShutdownSummary(w io.Writer, s shutdownSummary, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(s)
+	}
+	_, err := fmt.Fprintf(w, "运行 %v，客户端连接 %d，代理连接 %d (失败 %d)，上行 %d 字节，下行 %d 字节，丢弃 %d (解密失败 %d)\n",
+		time.Duration(s.UptimeSeconds)*time.Second, s.ClientConns, s.ProxyConns, s.ConnectFailed,
+		s.BytesUp, s.BytesDown, s.Dropped, s.DecryptFailed)
+	return err
+}
+
 func printBanner(cfg *Config) {
 	fmt.Println()
 	fmt.Println("╔══════════════════════════════════════════════════════════╗")
@@ -116,11 +627,18 @@ func printBanner(cfg *Config) {
 	fmt.Printf("║  监听: %-49s ║\n", cfg.Listen+" (TCP)")
 	fmt.Printf("║  时间窗口: %-45s ║\n", fmt.Sprintf("%d 秒", cfg.TimeWindow))
 	fmt.Printf("║  日志级别: %-45s ║\n", cfg.LogLevel)
+	if cfg.Admin != "" {
+		fmt.Printf("║  管理接口: %-45s ║\n", cfg.Admin)
+	}
 	fmt.Println("╠══════════════════════════════════════════════════════════╣")
 	fmt.Println("║  特性:                                                   ║")
 	fmt.Println("║    ✓ TCP 可靠传输                                        ║")
 	fmt.Println("║    ✓ TSKD 时间同步密钥派生                               ║")
-	fmt.Println("║    ✓ ChaCha20-Poly1305 加密                              ║")
+	cipherTitle := "ChaCha20-Poly1305"
+	if suite, _ := crypto.ParseCipher(cfg.Cipher); suite == crypto.CipherAES256GCM {
+		cipherTitle = "AES-256-GCM"
+	}
+	fmt.Printf("║    ✓ %-17s 加密                              ║\n", cipherTitle)
 	fmt.Println("║    ✓ 全密文无特征                                        ║")
 	fmt.Println("╠══════════════════════════════════════════════════════════╣")
 	fmt.Println("║  按 Ctrl+C 停止                                          ║")
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/crypto"
+	"github.com/anthropics/phantom-server/internal/handler"
+	"github.com/anthropics/phantom-server/internal/protocol"
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// writeConfig 写入临时配置文件
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("写入配置失败: %v", err)
+	}
+	return path
+}
+
+func TestValidateConfig(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	good := writeConfig(t, "listen: \"127.0.0.1:54321\"\npsk: \""+psk+"\"\n")
+	if err := validateConfig(good); err != nil {
+		t.Errorf("合法配置校验失败: %v", err)
+	}
+
+	bad := writeConfig(t, "listen: \":54321\"\npsk: \"not-a-valid-psk\"\n")
+	if err := validateConfig(bad); err == nil {
+		t.Error("无效 PSK 应该校验失败")
+	}
+
+	badListen := writeConfig(t, "listen: \"127.0.0.1\"\npsk: \""+psk+"\"\n")
+	if err := validateConfig(badListen); err == nil {
+		t.Error("无效监听地址应该校验失败")
+	}
+
+	routes := "psk: \"" + psk + "\"\nupstreams:\n  corp: \"http://127.0.0.1:3128\"\n" +
+		"routes:\n  - match: \"10.0.0.0/8\"\n    action: reject\n  - match: \"*.corp.example\"\n    action: corp\n"
+	if err := validateConfig(writeConfig(t, routes)); err != nil {
+		t.Errorf("合法路由配置校验失败: %v", err)
+	}
+	if err := validateConfig(writeConfig(t, strings.Replace(routes, "action: corp", "action: other", 1))); err == nil {
+		t.Error("引用未定义出口的路由应该校验失败")
+	}
+
+	// window_slack 有上限；time_window × (window_slack + 1) 不能超出 2 字节时间戳的范围
+	for _, tt := range []struct {
+		window, slack int
+		ok            bool
+	}{
+		{30, crypto.MaxWindowSlack, true},
+		{30, crypto.MaxWindowSlack + 1, false},
+		{30, -1, false},
+		{10000, 2, true},
+		{10000, 3, false},
+		{0, 1, false},
+	} {
+		path := writeConfig(t, fmt.Sprintf("psk: %q\ntime_window: %d\nwindow_slack: %d\n", psk, tt.window, tt.slack))
+		if err := validateConfig(path); (err == nil) != tt.ok {
+			t.Errorf("time_window=%d window_slack=%d: %v", tt.window, tt.slack, err)
+		}
+	}
+
+	badCache := writeConfig(t, "psk: \""+psk+"\"\nnonce_cache_size: -1\n")
+	if err := validateConfig(badCache); err == nil {
+		t.Error("负数的 nonce_cache_size 应该校验失败")
+	}
+}
+
+func TestLoadConfigFromStdin(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	old := configStdin
+	configStdin = strings.NewReader("listen: \":12345\"\npsk: \"" + psk + "\"\n")
+	defer func() { configStdin = old }()
+
+	cfg, err := loadConfig("-")
+	if err != nil {
+		t.Fatalf("从 stdin 加载失败: %v", err)
+	}
+	if cfg.Listen != ":12345" || cfg.PSK != psk {
+		t.Errorf("配置内容错误: %+v", cfg)
+	}
+}
+
+func TestLoadConfigFromURL(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "listen: \":23456\"\npsk: \"%s\"\n", psk)
+	}))
+	defer srv.Close()
+
+	old := configHTTPClient
+	configHTTPClient = srv.Client()
+	defer func() { configHTTPClient = old }()
+
+	cfg, err := loadConfig(srv.URL + "/config.yaml")
+	if err != nil {
+		t.Fatalf("从 URL 加载失败: %v", err)
+	}
+	if cfg.Listen != ":23456" {
+		t.Errorf("配置内容错误: %+v", cfg)
+	}
+
+	if _, err := loadConfig(srv.URL + "/missing"); err == nil {
+		t.Error("非 200 响应应该加载失败")
+	}
+	if _, err := loadConfig("http://127.0.0.1/config.yaml"); err == nil {
+		t.Error("非 TLS 的 URL 应该被拒绝")
+	}
+}
+
+func TestPrintStartupJSON(t *testing.T) {
+	cfg := &Config{Compression: true, FlowWindow: 65536, ProbeDecoy: "http", Cipher: "aes-256-gcm"}
+	info := newStartupInfo(cfg, "127.0.0.1:54321")
+	info.Admin = "127.0.0.1:54322"
+
+	var buf bytes.Buffer
+	if err := printStartupJSON(&buf, info); err != nil {
+		t.Fatalf("输出失败: %v", err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("应输出单行 JSON: %q", buf.String())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("输出不是合法 JSON: %v", err)
+	}
+	for _, key := range []string{"version", "build", "commit", "listen", "admin", "features"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("缺少字段 %s: %s", key, buf.String())
+		}
+	}
+	if got["version"] != Version {
+		t.Errorf("版本错误: %v", got["version"])
+	}
+	features := fmt.Sprint(got["features"])
+	for _, f := range []string{"compression", "flow_control", "probe_decoy:http", "aes-256-gcm"} {
+		if !strings.Contains(features, f) {
+			t.Errorf("特性列表缺少 %s: %s", f, features)
+		}
+	}
+	if strings.Contains(features, "access_log") {
+		t.Errorf("未开启的特性不应出现: %s", features)
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	summary := newShutdownSummary(90*time.Second+400*time.Millisecond,
+		transport.ServerStats{ActiveConns: 1, TotalConns: 12},
+		handler.Stats{
+			TotalConns:      30,
+			ConnectFailed:   2,
+			DecryptFailed:   5,
+			EncryptFailed:   1,
+			UnknownFrames:   3,
+			BytesToTarget:   1000,
+			BytesFromTarget: 5000,
+		})
+	want := shutdownSummary{
+		UptimeSeconds: 90,
+		ClientConns:   12,
+		ProxyConns:    30,
+		ConnectFailed: 2,
+		BytesUp:       1000,
+		BytesDown:     5000,
+		Dropped:       9,
+		DecryptFailed: 5,
+	}
+	if summary != want {
+		t.Errorf("摘要错误:\n got %+v\nwant %+v", summary, want)
+	}
+
+	var buf bytes.Buffer
+	if err := printShutdownSummary(&buf, summary, true); err != nil {
+		t.Fatalf("输出失败: %v", err)
+	}
+	var got shutdownSummary
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got != want {
+		t.Errorf("JSON 摘要错误: %s %v", buf.String(), err)
+	}
+
+	buf.Reset()
+	printShutdownSummary(&buf, summary, false)
+	if !strings.Contains(buf.String(), "1m30s") || !strings.Contains(buf.String(), "丢弃 9") {
+		t.Errorf("文本摘要错误: %s", buf.String())
+	}
+}
+
+func TestReadPSK(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	got, err := readPSK(strings.NewReader("  " + psk + "\r\nignored\n"))
+	if err != nil || got != psk {
+		t.Fatalf("读取 PSK 失败: %q %v", got, err)
+	}
+
+	for _, input := range []string{"", "\n", "not-base64\n", "c2hvcnQ=\n"} {
+		if _, err := readPSK(strings.NewReader(input)); err == nil {
+			t.Errorf("无效输入 %q 应该被拒绝", input)
+		}
+	}
+
+	// 读取到的 PSK 覆盖配置文件中的空 psk
+	path := writeConfig(t, "listen: \"127.0.0.1:54321\"\n")
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("缺少 psk 的配置应该加载失败")
+	}
+	cfg, err := loadConfig(path, func(cfg *Config) { cfg.PSK = got })
+	if err != nil || cfg.PSK != psk {
+		t.Fatalf("使用读取的 PSK 加载配置失败: %v", err)
+	}
+}
+
+func TestPSKSources(t *testing.T) {
+	inline, _ := crypto.GeneratePSK()
+	fromFile, _ := crypto.GeneratePSK()
+	fromEnv, _ := crypto.GeneratePSK()
+	dir := t.TempDir()
+	pskFile := filepath.Join(dir, "psk")
+	if err := os.WriteFile(pskFile, []byte(fromFile+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(content string) (*Config, error) {
+		t.Helper()
+		return loadConfig(writeConfig(t, content))
+	}
+
+	cfg, err := load("psk: \"" + inline + "\"\npsk_file: \"" + pskFile + "\"\n")
+	if err != nil || cfg.PSK != fromFile {
+		t.Errorf("psk_file 应优先于 psk: %v", err)
+	}
+	cfg, err = load("psk_file: \"" + pskFile + "\"\n")
+	if err != nil || cfg.PSK != fromFile {
+		t.Errorf("只配置 psk_file 时应读取文件: %v", err)
+	}
+
+	// 文件缺失或密钥长度错误时给出明确错误
+	if _, err := load("psk_file: \"" + filepath.Join(dir, "missing") + "\"\n"); err == nil || !strings.Contains(err.Error(), "psk_file") {
+		t.Errorf("文件缺失应报错: %v", err)
+	}
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte("c2hvcnQ=\n"), 0o600)
+	if _, err := load("psk_file: \"" + short + "\"\n"); err == nil || !strings.Contains(err.Error(), short) {
+		t.Errorf("长度错误的密钥应报错: %v", err)
+	}
+
+	t.Setenv(pskEnv, fromEnv)
+	cfg, err = load("psk: \"" + inline + "\"\npsk_file: \"" + pskFile + "\"\n")
+	if err != nil || cfg.PSK != fromEnv {
+		t.Errorf("环境变量应优先于 psk_file 与 psk: %v", err)
+	}
+	cfg, err = load("listen: \":54321\"\n")
+	if err != nil || cfg.PSK != fromEnv {
+		t.Errorf("只有环境变量时应使用它: %v", err)
+	}
+	t.Setenv(pskEnv, "not-a-psk")
+	if _, err := load("psk: \"" + inline + "\"\n"); err == nil || !strings.Contains(err.Error(), pskEnv) {
+		t.Errorf("无效的环境变量应报错: %v", err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	results := runSelfTest()
+	if len(results) != 4 {
+		t.Fatalf("应执行 4 个阶段: %d", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s 失败: %v", r.Name, r.Err)
+		}
+	}
+
+	var out bytes.Buffer
+	if !printSelfTest(&out, results) {
+		t.Error("全部通过时应返回 true")
+	}
+	if !strings.Contains(out.String(), "代理回显") {
+		t.Errorf("报告缺少阶段名: %s", out.String())
+	}
+	if printSelfTest(io.Discard, []selftestStage{{Name: "x", Err: io.EOF}}) {
+		t.Error("有失败阶段时应返回 false")
+	}
+}
+
+func TestReplayFrames(t *testing.T) {
+	psk, _ := crypto.GeneratePSK()
+	captured := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+	client, err := crypto.New(psk, 30, crypto.WithClock(func() time.Time { return captured }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect, _ := protocol.BuildConnect(7, protocol.NetworkTCP, "example.com", 443, []byte("hello"))
+	var capture bytes.Buffer
+	for i, msg := range [][]byte{
+		connect,
+		protocol.BuildData(7, []byte("payload")),
+		protocol.BuildData(7, []byte("tampered")),
+		protocol.BuildCloseReason(7, protocol.CloseReasonTargetClosed),
+	} {
+		encrypted, err := client.Encrypt(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			encrypted[len(encrypted)-1] ^= 0xFF
+		}
+		capture.Write(binary.BigEndian.AppendUint16(nil, uint16(len(encrypted))))
+		capture.Write(encrypted)
+	}
+
+	// 给出的开始时间与实际相差一小时，仍应按时间戳还原
+	var out bytes.Buffer
+	if err := replayFrames(&capture, psk, 30, captured.Add(time.Hour), &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"#1 15:04:05 Connect id=7 tcp example.com:443 init=5 字节",
+		"#2 15:04:05 Data id=7 7 字节",
+		"#3 15:04:05 ",
+		"#4 15:04:05 Close id=7 reason=0x01",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("应输出 %d 行: %q", len(want), lines)
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("第 %d 行 = %q, want %q", i+1, lines[i], want[i])
+		}
+	}
+	if !strings.Contains(lines[2], "解密失败") {
+		t.Errorf("篡改的帧应报告解密失败: %q", lines[2])
+	}
+
+	// 截断的流报告错误
+	truncated := []byte{0x00, 0x10, 0x01}
+	if err := replayFrames(bytes.NewReader(truncated), psk, 30, captured, io.Discard); err == nil {
+		t.Error("截断的帧应返回错误")
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	if listener, err := inheritedListener(); listener != nil || err != nil {
+		t.Fatalf("没有继承时应返回 nil: %v %v", listener, err)
+	}
+
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+	f, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inheritedListener 会关闭传入的描述符，交给它一个独立的副本
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(listenFDEnv, strconv.Itoa(fd))
+
+	listener, err := inheritedListener()
+	if err != nil {
+		t.Fatalf("恢复监听器失败: %v", err)
+	}
+	defer listener.Close()
+	if listener.Addr().String() != original.Addr().String() {
+		t.Errorf("地址不一致: %s != %s", listener.Addr(), original.Addr())
+	}
+	if os.Getenv(listenFDEnv) != "" {
+		t.Error("环境变量应在读取后清除")
+	}
+
+	t.Setenv(listenFDEnv, "x")
+	if _, err := inheritedListener(); err == nil {
+		t.Error("无效的描述符应返回错误")
+	}
+}
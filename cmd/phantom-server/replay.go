@@ -0,0 +1,132 @@
+//cmd/phantom-server/replay.go
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/crypto"
+	"github.com/anthropics/phantom-server/internal/protocol"
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// runReplay 实现 -replay: 解码 path 中的帧序列并输出到标准输出
+func runReplay(path, startTime string, cfg *Config) error {
+	start := time.Now()
+	if startTime != "" {
+		t, err := time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			return fmt.Errorf("-replay-time 应为 RFC 3339 格式 (如 2024-01-02T15:04:05+08:00): %w", err)
+		}
+		start = t
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	suite, _ := crypto.ParseCipher(cfg.Cipher)
+	return replayFrames(bufio.NewReader(f), cfg.PSK, cfg.TimeWindow, start, os.Stdout,
+		crypto.WithCipher(suite), crypto.WithWindowSlack(cfg.WindowSlack))
+}
+
+// replayFrames 离线解码抓取的一个方向的 TCP 流 (长度前缀帧序列)，逐帧输出协议事件
+// 不发起任何网络连接。抓包中的时间戳只有低 16 位，start 为抓包开始时间的近似值
+// (误差需在约 9 小时以内)，之后按每帧的时间戳推算发送时间，长时间的抓包也能解码
+// opts 追加到解密使用的 Crypto 配置 (如加密套件)
+func replayFrames(r io.Reader, psk string, timeWindow int, start time.Time, w io.Writer, opts ...crypto.Option) error {
+	// 时钟随帧推进；Crypto 的后台清理也会读取时钟，用原子变量保存 (Unix 秒)
+	var clock atomic.Int64
+	clock.Store(start.Unix())
+	now := func() time.Time { return time.Unix(clock.Load(), 0) }
+	cry, err := crypto.New(psk, timeWindow, append([]crypto.Option{
+		crypto.WithDisableReplayProtection(true), // 分析时同一帧可能出现多次
+		crypto.WithClock(now),
+	}, opts...)...)
+	if err != nil {
+		return err
+	}
+
+	lengthBuf := make([]byte, transport.LengthPrefixSize)
+	for index := 1; ; index++ {
+		if _, err := io.ReadFull(r, lengthBuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("#%d: 读取帧长度失败: %w", index, err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return fmt.Errorf("#%d: 帧被截断: %w", index, err)
+		}
+
+		if len(frame) >= crypto.HeaderSize {
+			ts := binary.BigEndian.Uint16(frame[crypto.UserIDSize:crypto.HeaderSize])
+			clock.Store(frameTime(now(), ts).Unix())
+		}
+		plaintext, err := cry.Decrypt(frame)
+		if err != nil {
+			fmt.Fprintf(w, "#%d %s %d 字节 解密失败: %v\n", index, now().Format(time.TimeOnly), len(frame), err)
+			continue
+		}
+		fmt.Fprintf(w, "#%d %s %s\n", index, now().Format(time.TimeOnly), describeMessage(plaintext))
+	}
+}
+
+// frameTime 返回离 ref 最近、低 16 位等于 ts 的时间
+func frameTime(ref time.Time, ts uint16) time.Time {
+	sec := ref.Unix()
+	return time.Unix(sec+int64(int16(ts-uint16(sec))), 0)
+}
+
+// describeMessage 把解密后的消息格式化为一行可读的事件
+func describeMessage(msg []byte) string {
+	if len(msg) > 0 && msg[0] == protocol.TypeData|protocol.FlagCompressed {
+		if len(msg) < 5 {
+			return "Data(压缩) 数据太短"
+		}
+		return fmt.Sprintf("Data(压缩) id=%d %d 字节", binary.BigEndian.Uint32(msg[1:5]), len(msg)-5)
+	}
+
+	req, err := protocol.ParseRequest(msg)
+	if err != nil {
+		return fmt.Sprintf("无法解析: %v", err)
+	}
+	switch req.Type {
+	case protocol.TypeConnect:
+		s := fmt.Sprintf("Connect id=%d %s %s init=%d 字节", req.ReqID, req.NetworkString(), req.TargetAddr(), len(req.Data))
+		if req.ConnectTimeout > 0 {
+			s += fmt.Sprintf(" timeout=%v", req.ConnectTimeout)
+		}
+		return s
+	case protocol.TypeConnectResp:
+		if len(req.Data) == 0 {
+			return fmt.Sprintf("ConnectResp id=%d 缺少状态", req.ReqID)
+		}
+		return fmt.Sprintf("ConnectResp id=%d status=0x%02x", req.ReqID, req.Data[0])
+	case protocol.TypeData:
+		return fmt.Sprintf("Data id=%d %d 字节", req.ReqID, len(req.Data))
+	case protocol.TypeClose:
+		return fmt.Sprintf("Close id=%d reason=0x%02x", req.ReqID, req.CloseReason())
+	case protocol.TypeResolve:
+		return fmt.Sprintf("Resolve id=%d %s", req.ReqID, req.Address)
+	case protocol.TypeResolveResp:
+		_, status, payload, _ := protocol.ParseResponse(msg)
+		ips, _ := protocol.ParseResolveAddrs(payload)
+		return fmt.Sprintf("ResolveResp id=%d status=0x%02x %v", req.ReqID, status, ips)
+	case protocol.TypeServerShutdown:
+		return "ServerShutdown"
+	case protocol.TypeWindowUpdate:
+		return fmt.Sprintf("WindowUpdate id=%d +%d", req.ReqID, binary.BigEndian.Uint32(req.Data))
+	case protocol.TypeTrafficHint:
+		return fmt.Sprintf("TrafficHint 0x%02x", req.Data[0])
+	default:
+		return fmt.Sprintf("类型 0x%02x id=%d", req.Type, req.ReqID)
+	}
+}
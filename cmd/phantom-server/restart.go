@@ -0,0 +1,101 @@
+//cmd/phantom-server/restart.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// 平滑重启时父进程通过环境变量告诉新进程继承的文件描述符
+const (
+	listenFDEnv = "PHANTOM_LISTEN_FD" // 监听套接字
+	readyFDEnv  = "PHANTOM_READY_FD"  // 就绪通知管道的写端
+)
+
+// restartReadyTimeout 等待新进程就绪的最长时间
+const restartReadyTimeout = 30 * time.Second
+
+// inheritedListener 返回父进程交接的监听套接字，不是由平滑重启启动时返回 nil
+func inheritedListener() (net.Listener, error) {
+	f, err := inheritedFile(listenFDEnv)
+	if f == nil || err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("恢复继承的监听套接字失败: %w", err)
+	}
+	return listener, nil
+}
+
+// notifyReady 通知父进程本进程已开始接受连接，父进程随后停止接受并排空现有连接
+func notifyReady() {
+	f, err := inheritedFile(readyFDEnv)
+	if f == nil || err != nil {
+		return
+	}
+	f.Write([]byte{1})
+	f.Close()
+}
+
+func inheritedFile(env string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env) // 不再传给以后的子进程
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("%s 无效: %q", env, value)
+	}
+	return os.NewFile(uintptr(fd), env), nil
+}
+
+// startSuccessor 以相同的参数启动新进程并把监听套接字交给它，等到新进程就绪后返回
+// 新进程与本进程共享同一个 accept 队列，交接期间不会拒绝或丢弃新连接
+// 新进程启动失败或超时未就绪时返回错误，本进程继续提供服务
+func startSuccessor(srv *transport.TCPServer) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listenerFile, err := srv.ListenerFile()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	// ExtraFiles 中的第 i 个文件在新进程中的描述符为 3+i
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{listenerFile, readyW}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close() // 新进程退出时读端随即返回 EOF
+	if err != nil {
+		return fmt.Errorf("启动新进程失败: %w", err)
+	}
+	go cmd.Wait() // 回收提前退出的新进程；就绪后本进程先于它退出
+
+	_ = readyR.SetReadDeadline(time.Now().Add(restartReadyTimeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("新进程 (pid %d) 未就绪: %w", cmd.Process.Pid, err)
+	}
+	fmt.Printf("新进程 (pid %d) 已接管监听端口\n", cmd.Process.Pid)
+	return nil
+}
@@ -0,0 +1,9 @@
+//cmd/phantom-server/restart_other.go
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartSignal 当前平台不支持平滑重启 (无法向子进程传递文件描述符)
+var restartSignal os.Signal
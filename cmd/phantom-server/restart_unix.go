@@ -0,0 +1,12 @@
+//cmd/phantom-server/restart_unix.go
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignal 触发平滑重启的信号
+var restartSignal os.Signal = syscall.SIGUSR2
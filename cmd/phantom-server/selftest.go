@@ -0,0 +1,209 @@
+//cmd/phantom-server/selftest.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/crypto"
+	"github.com/anthropics/phantom-server/internal/handler"
+	"github.com/anthropics/phantom-server/internal/protocol"
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// selftestTimeout 单个自检阶段的超时
+const selftestTimeout = 5 * time.Second
+
+// selftestStage 一个自检阶段的结果
+type selftestStage struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// runSelfTest 在进程内依次检查各子系统，不监听对外端口
+// 回显目标只监听 127.0.0.1 的临时端口，客户端与 Handler 之间用 net.Pipe 连接
+func runSelfTest() []selftestStage {
+	var (
+		psk string
+		cry *crypto.Crypto
+	)
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"生成 PSK", func() (err error) {
+			psk, err = crypto.GeneratePSK()
+			return err
+		}},
+		{"加密模块", func() (err error) {
+			if cry, err = crypto.New(psk, 30); err != nil {
+				return err
+			}
+			return selftestCrypto(cry)
+		}},
+		{"协议编解码", selftestProtocol},
+		{"代理回显", func() error {
+			return selftestProxy(psk, cry)
+		}},
+	}
+
+	results := make([]selftestStage, 0, len(stages))
+	for _, stage := range stages {
+		start := time.Now()
+		err := stage.run()
+		results = append(results, selftestStage{Name: stage.name, Duration: time.Since(start), Err: err})
+		if err != nil {
+			// 后续阶段依赖前面的结果
+			break
+		}
+	}
+	return results
+}
+
+// printSelfTest 输出自检报告，返回是否全部通过
+func printSelfTest(w io.Writer, results []selftestStage) bool {
+	passed := true
+	for _, r := range results {
+		// 阶段名含中文，放在行尾避免对齐错乱
+		if r.Err != nil {
+			fmt.Fprintf(w, "  失败 %10s  %s: %v\n", r.Duration.Round(time.Microsecond), r.Name, r.Err)
+			passed = false
+			continue
+		}
+		fmt.Fprintf(w, "  通过 %10s  %s\n", r.Duration.Round(time.Microsecond), r.Name)
+	}
+	return passed
+}
+
+func selftestCrypto(cry *crypto.Crypto) error {
+	plaintext := []byte("phantom selftest")
+	encrypted, err := cry.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("加密失败: %w", err)
+	}
+	decrypted, err := cry.Decrypt(encrypted)
+	if err != nil {
+		return fmt.Errorf("解密失败: %w", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("解密结果不一致")
+	}
+
+	encrypted[len(encrypted)-1] ^= 0xFF
+	if _, err := cry.Decrypt(encrypted); err == nil {
+		return fmt.Errorf("篡改的数据没有被拒绝")
+	}
+	return nil
+}
+
+func selftestProtocol() error {
+	msg, err := protocol.BuildConnect(1, protocol.NetworkTCP, "example.com", 443, []byte("init"))
+	if err != nil {
+		return err
+	}
+	req, err := protocol.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if req.TargetAddr() != "example.com:443" || string(req.Data) != "init" {
+		return fmt.Errorf("Connect 往返结果错误: %s", req.TargetAddr())
+	}
+	return nil
+}
+
+// selftestProxy 经 Handler 连接进程内的回显目标，验证首包数据与后续数据都能往返
+func selftestProxy(psk string, serverCrypto *crypto.Crypto) error {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("启动回显目标失败: %w", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// 客户端使用独立的 Crypto 实例，与真实部署一致
+	clientCrypto, err := crypto.New(psk, 30)
+	if err != nil {
+		return err
+	}
+	h := handler.NewTCPHandler(serverCrypto, "error")
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		h.HandleConnection(ctx, serverConn)
+	}()
+	context.AfterFunc(ctx, func() { clientConn.Close() })
+
+	reader := transport.NewFrameReader(clientConn, selftestTimeout)
+	writer := transport.NewFrameWriter(clientConn, selftestTimeout)
+	send := func(msg []byte) error {
+		encrypted, err := clientCrypto.Encrypt(msg)
+		if err != nil {
+			return err
+		}
+		return writer.WriteFrame(encrypted)
+	}
+	recv := func() ([]byte, error) {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		return clientCrypto.Decrypt(frame)
+	}
+
+	target := echo.Addr().(*net.TCPAddr)
+	connect, err := protocol.BuildConnect(1, protocol.NetworkTCP, target.IP.String(), uint16(target.Port), []byte("ping"))
+	if err != nil {
+		return err
+	}
+	if err := send(connect); err != nil {
+		return fmt.Errorf("发送 Connect 失败: %w", err)
+	}
+	resp, err := recv()
+	if err != nil {
+		return fmt.Errorf("读取连接响应失败: %w", err)
+	}
+	if _, status, _, err := protocol.ParseResponse(resp); err != nil || status != protocol.StatusOK {
+		return fmt.Errorf("连接回显目标失败: status=0x%02x err=%v", status, err)
+	}
+
+	if err := send(protocol.BuildData(1, []byte("pong"))); err != nil {
+		return fmt.Errorf("发送数据失败: %w", err)
+	}
+	var got []byte
+	for len(got) < len("pingpong") {
+		msg, err := recv()
+		if err != nil {
+			return fmt.Errorf("读取回显数据失败: %w", err)
+		}
+		req, err := protocol.ParseRequest(msg)
+		if err != nil || req.Type != protocol.TypeData || req.ReqID != 1 {
+			return fmt.Errorf("收到意外的消息: %x", msg)
+		}
+		got = append(got, req.Data...)
+	}
+	if string(got) != "pingpong" {
+		return fmt.Errorf("回显数据不一致: %q", got)
+	}
+	return nil
+}
@@ -1,11 +1,10 @@
-
-
 module github.com/anthropics/phantom-server
 
 go 1.24.0
 
 require (
 	golang.org/x/crypto v0.47.0
+	golang.org/x/term v0.39.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,249 @@
+// internal/admin/admin.go
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/phantom-server/internal/handler"
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// Server 管理控制接口
+// 协议: 每行一条命令，每条命令返回一行 JSON
+//
+//	list              列出活跃连接
+//	stats             查看统计信息
+//	close <id>        按 ID 关闭连接
+//	loglevel <level>  修改日志级别 (debug, info, error)
+type Server struct {
+	addr     string
+	handler  *handler.TCPHandler
+	server   *transport.TCPServer
+	listener net.Listener
+
+	conns  sync.Map
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Response 命令响应
+type Response struct {
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// StatsData stats 命令返回的数据
+type StatsData struct {
+	Handler handler.Stats         `json:"handler"`
+	Server  transport.ServerStats `json:"server"`
+}
+
+// New 创建管理接口，srv 可以为 nil
+func New(addr string, h *handler.TCPHandler, srv *transport.TCPServer) *Server {
+	return &Server{
+		addr:    localAddr(addr),
+		handler: h,
+		server:  srv,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// UnixPrefix 以该前缀开头的地址表示 Unix socket 路径，如 unix:/run/phantom/admin.sock
+const UnixPrefix = "unix:"
+
+// unixSocketMode Unix socket 文件的权限，只允许属主访问
+const unixSocketMode = 0o600
+
+// localAddr 未指定主机时只绑定本地回环
+func localAddr(addr string) string {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// Start 启动监听
+func (s *Server) Start() error {
+	listener, err := listen(s.addr)
+	if err != nil {
+		return fmt.Errorf("管理接口监听失败: %w", err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return nil
+}
+
+// listen 监听 TCP 地址或 Unix socket
+// Unix socket 会先删除残留的旧 socket 文件，创建后权限设为仅属主可访问
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("Unix socket 路径为空")
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s 已存在且不是 socket", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	// 在 umask 之外再显式收紧权限；Listen 与 Chmod 之间的短暂窗口由所在目录的权限保护
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Addr 返回实际监听地址
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop 停止管理接口
+func (s *Server) Stop() {
+	close(s.stopCh)
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.conns.Range(func(key, _ interface{}) bool {
+		if conn, ok := key.(net.Conn); ok {
+			_ = conn.Close()
+		}
+		return true
+	})
+	s.wg.Wait()
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.stopCh:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		s.conns.Store(conn, struct{}{})
+		// Stop 可能已遍历过 conns，此时由这里关闭，避免 serve 阻塞导致 Stop 无法返回
+		select {
+		case <-s.stopCh:
+			s.conns.Delete(conn)
+			_ = conn.Close()
+			return
+		default:
+		}
+		s.wg.Add(1)
+		go func(c net.Conn) {
+			defer s.wg.Done()
+			defer func() {
+				s.conns.Delete(c)
+				_ = c.Close()
+			}()
+			s.serve(c)
+		}(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := enc.Encode(s.Exec(line)); err != nil {
+			return
+		}
+	}
+}
+
+// Exec 执行一条命令
+func (s *Server) Exec(line string) Response {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Response{Error: "空命令"}
+	}
+
+	switch fields[0] {
+	case "list":
+		conns := s.handler.Conns()
+		if conns == nil {
+			conns = []handler.ConnInfo{}
+		}
+		return Response{OK: true, Data: conns}
+
+	case "stats":
+		data := StatsData{Handler: s.handler.Stats()}
+		if s.server != nil {
+			data.Server = s.server.Stats()
+		}
+		return Response{OK: true, Data: data}
+
+	case "close":
+		if len(fields) != 2 {
+			return Response{Error: "用法: close <id>"}
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return Response{Error: fmt.Sprintf("无效的连接 ID: %s", fields[1])}
+		}
+		if !s.handler.CloseConn(uint32(id)) {
+			return Response{Error: fmt.Sprintf("连接不存在: %d", id)}
+		}
+		return Response{OK: true}
+
+	case "loglevel":
+		if len(fields) != 2 {
+			return Response{Error: "用法: loglevel <debug|info|error>"}
+		}
+		switch fields[1] {
+		case "debug", "info", "error":
+		default:
+			return Response{Error: fmt.Sprintf("未知日志级别: %s", fields[1])}
+		}
+		s.handler.SetLogLevel(fields[1])
+		if s.server != nil {
+			s.server.SetLogLevel(fields[1])
+		}
+		return Response{OK: true}
+
+	default:
+		return Response{Error: fmt.Sprintf("未知命令: %s", fields[0])}
+	}
+}
@@ -0,0 +1,269 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/crypto"
+	"github.com/anthropics/phantom-server/internal/handler"
+	"github.com/anthropics/phantom-server/internal/protocol"
+	"github.com/anthropics/phantom-server/internal/transport"
+)
+
+// setupConn 通过 net.Pipe 建立一条到本地目标的代理连接
+func setupConn(t *testing.T, cry *crypto.Crypto, h *handler.TCPHandler, reqID uint32) {
+	t.Helper()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go h.HandleConnection(ctx, server)
+
+	addr := target.Addr().(*net.TCPAddr)
+	msg, err := protocol.BuildConnect(reqID, protocol.NetworkTCP, addr.IP.String(), uint16(addr.Port), nil)
+	if err != nil {
+		t.Fatalf("构造 Connect 失败: %v", err)
+	}
+
+	encrypted, err := cry.Encrypt(msg)
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	if err := transport.NewFrameWriter(client, time.Second).WriteFrame(encrypted); err != nil {
+		t.Fatalf("发送 Connect 失败: %v", err)
+	}
+
+	frame, err := transport.NewFrameReader(client, time.Second).ReadFrame()
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	resp, err := cry.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("解密响应失败: %v", err)
+	}
+	if resp[0] != protocol.TypeConnectResp || resp[5] != protocol.StatusOK {
+		t.Fatalf("连接失败: %v", resp)
+	}
+}
+
+func TestAdminListAndStats(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := handler.NewTCPHandler(cry, "error")
+	defer h.Close()
+	setupConn(t, cry, h, 7)
+
+	srv := New(":0", h, nil)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("启动管理接口失败: %v", err)
+	}
+	defer srv.Stop()
+
+	if host, _, _ := net.SplitHostPort(srv.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("默认应绑定本地地址: %s", srv.Addr())
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("连接管理接口失败: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	exec := func(cmd string, data interface{}) Response {
+		t.Helper()
+		if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatalf("发送命令失败: %v", err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("读取响应失败: %v", err)
+		}
+		resp := Response{Data: data}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("响应不是 JSON: %s", line)
+		}
+		return resp
+	}
+
+	var conns []handler.ConnInfo
+	if resp := exec("list", &conns); !resp.OK {
+		t.Fatalf("list 失败: %s", resp.Error)
+	}
+	if len(conns) != 1 || conns[0].ID != 7 || conns[0].Network != "tcp" {
+		t.Fatalf("list 结果错误: %+v", conns)
+	}
+
+	var stats StatsData
+	if resp := exec("stats", &stats); !resp.OK {
+		t.Fatalf("stats 失败: %s", resp.Error)
+	}
+	if stats.Handler.ActiveConns != 1 || stats.Handler.TotalConns != 1 || stats.Handler.Windows.Current == 0 {
+		t.Errorf("stats 结果错误: %+v", stats.Handler)
+	}
+
+	if resp := exec("close 7", nil); !resp.OK {
+		t.Errorf("close 失败: %s", resp.Error)
+	}
+	if resp := exec("close 7", nil); resp.OK {
+		t.Error("重复 close 应该失败")
+	}
+	if resp := exec("loglevel verbose", nil); resp.OK {
+		t.Error("未知日志级别应该被拒绝")
+	}
+	if resp := exec("bogus", nil); resp.OK || resp.Error == "" {
+		t.Error("未知命令应该返回错误")
+	}
+}
+
+func TestAdminUnixSocket(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	h := handler.NewTCPHandler(cry, "error")
+	defer h.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+
+	// 上次运行残留的 socket 文件不影响启动
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("创建残留 socket 失败: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := New(UnixPrefix+path, h, nil)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("启动管理接口失败: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket 文件不存在: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket 权限 = %o, 期望 600", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("连接 Unix socket 失败: %v", err)
+	}
+	if _, err := conn.Write([]byte("stats\n")); err != nil {
+		t.Fatalf("发送命令失败: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("读取响应失败: %v", err)
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil || !resp.OK {
+		t.Errorf("stats 响应错误: %s", line)
+	}
+	conn.Close()
+
+	srv.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("停止后 socket 文件应被删除: %v", err)
+	}
+
+	// 路径被普通文件占用时拒绝启动，不删除该文件
+	if err := os.WriteFile(path, []byte("keep"), 0o644); err != nil {
+		t.Fatalf("写入文件失败: %v", err)
+	}
+	if err := New(UnixPrefix+path, h, nil).Start(); err == nil {
+		t.Error("路径被普通文件占用时应启动失败")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "keep" {
+		t.Error("普通文件不应被删除")
+	}
+}
+
+// lateListener 模拟 Accept 拿到连接后 Stop 才执行：连接在 Close 之后稍晚才返回
+type lateListener struct {
+	net.Listener
+	closed chan struct{}
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	<-l.closed
+	time.Sleep(50 * time.Millisecond) // 等 Stop 遍历完已有连接
+	return conn, nil
+}
+
+func (l *lateListener) Close() error {
+	err := l.Listener.Close()
+	close(l.closed)
+	return err
+}
+
+// TestAdminStopLateAccept Stop 期间才 Accept 返回的空闲客户端不应阻塞 Stop
+func TestAdminStopLateAccept(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	srv := New("", nil, nil)
+	srv.listener = &lateListener{Listener: listener, closed: make(chan struct{})}
+	srv.wg.Add(1)
+	go srv.acceptLoop()
+
+	// 客户端连入后不发送任何命令
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("连接管理接口失败: %v", err)
+	}
+	defer conn.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("存在空闲客户端时 Stop 未返回")
+	}
+}
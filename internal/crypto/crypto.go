@@ -2,14 +2,18 @@
 package crypto
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -23,40 +27,246 @@ const (
 	NonceSize     = chacha20poly1305.NonceSize // 12
 	TagSize       = chacha20poly1305.Overhead  // 16
 	HeaderSize    = UserIDSize + TimestampSize // 6
+
+	// WindowSlack 默认的窗口容差: 当前窗口前后各额外接受的窗口数
+	WindowSlack = 1
+	// MaxWindowSlack 窗口容差的上限，限制密钥派生与 AEAD 缓存随容差增长
+	MaxWindowSlack = 4
+	// MaxTimestampSkew 2 字节时间戳经环绕处理后能无歧义表示的最大偏差（秒）
+	MaxTimestampSkew = 1<<15 - 1
+
+	// DefaultCleanupInterval 默认的缓存清理间隔
+	DefaultCleanupInterval = 30 * time.Second
+	// DefaultSendNonceCacheSize 发送端 nonce 缓存的默认条目上限
+	// 发送端去重只防范随机数碰撞，淘汰旧条目不影响安全性
+	DefaultSendNonceCacheSize = 1 << 16
+	// DefaultRecvNonceCacheSize 接收端 nonce (重放) 缓存的默认条目上限，约占用 64MB
+	DefaultRecvNonceCacheSize = 1 << 20
+)
+
+// Cipher AEAD 套件，两端必须一致
+// 不同套件使用不同的 HKDF info 派生 UserID 与密钥，套件不一致时在 UserID 校验阶段即被拒绝
+type Cipher byte
+
+const (
+	CipherChaCha20Poly1305 Cipher = iota // 默认，无 AES 硬件加速时更快
+	CipherAES256GCM                      // 有 AES-NI 等硬件加速时更快
 )
 
+// cipherLabels 各套件的名称与 HKDF info 后缀；ChaCha20-Poly1305 沿用原有的 info，保持兼容
+var cipherLabels = map[Cipher]struct{ name, suffix string }{
+	CipherChaCha20Poly1305: {"chacha20-poly1305", ""},
+	CipherAES256GCM:        {"aes-256-gcm", "-aes256gcm"},
+}
+
+func (s Cipher) String() string {
+	if l, ok := cipherLabels[s]; ok {
+		return l.name
+	}
+	return fmt.Sprintf("cipher(%d)", byte(s))
+}
+
+// ParseCipher 将配置中的套件名转换为 Cipher，空字符串表示默认套件
+func ParseCipher(name string) (Cipher, error) {
+	if name == "" {
+		return CipherChaCha20Poly1305, nil
+	}
+	for s, l := range cipherLabels {
+		if l.name == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("未知的加密套件: %q (可选 chacha20-poly1305, aes-256-gcm)", name)
+}
+
 // Crypto 加密器
 type Crypto struct {
 	psk        []byte
 	userID     [UserIDSize]byte
 	timeWindow int
+	cipher     Cipher
+
+	cleanupInterval time.Duration
+	replayDisabled  bool
+	random          io.Reader // 随机源，默认 crypto/rand
+	windowSlack     int
+	sendCacheSize   int
+	recvCacheSize   int
+	aeadRetention   int              // AEAD 缓存保留的过期窗口数
+	pastTolerance   time.Duration    // 可接受的时间戳落后量，0 表示按窗口容差
+	futureTolerance time.Duration    // 可接受的时间戳超前量，0 表示按窗口容差
+	now             func() time.Time // 时钟，测试中可替换
 
 	aeadCache sync.Map // window -> cipher.AEAD
 
+	// 解密成功时所在窗口相对当前窗口的分布，用于排查时钟偏差
+	windowHits  [3]atomic.Int64 // w-1, w, w+1
+	windowOther atomic.Int64    // 偏差超过 1 个窗口 (windowSlack > 1 时)
+
 	// 改进：分离接收和发送的 Nonce 缓存
-	recvNonceCache sync.Map // 接收到的 nonce -> time.Time
-	sendNonceCache sync.Map // 发送过的 nonce -> time.Time
+	recvNonceCache *nonceCache // 接收到的 nonce，记录数据包的发送时间
+	sendNonceCache *nonceCache // 发送过的 nonce
 
 	mu sync.RWMutex
 }
 
+// Option Crypto 配置项
+type Option func(*Crypto)
+
+// WithCleanupInterval 设置 Nonce 与 AEAD 缓存的清理间隔
+func WithCleanupInterval(d time.Duration) Option {
+	return func(c *Crypto) {
+		if d > 0 {
+			c.cleanupInterval = d
+		}
+	}
+}
+
+// WithDisableReplayProtection 关闭接收方向的重放检测
+//
+// 警告：关闭后同一密文可以被任意次重放并成功解密，攻击者录下的流量
+// 在时间窗口内都能被原样重放给目标。仅用于本身幂等、且重放缓存的内存
+// 开销不可接受的高吞吐数据报中继，默认开启重放检测。
+func WithDisableReplayProtection(disable bool) Option {
+	return func(c *Crypto) {
+		c.replayDisabled = disable
+	}
+}
+
+// WithClock 替换时间戳校验和窗口计算使用的时钟
+// 用于离线分析抓包时，把时钟设为数据包被发送时的时间
+func WithClock(now func() time.Time) Option {
+	return func(c *Crypto) {
+		if now != nil {
+			c.now = now
+		}
+	}
+}
+
+// WithWindowSlack 设置窗口容差，即当前窗口前后各额外接受的窗口数，不能超过 MaxWindowSlack
+// 容差越大越能容忍时钟偏差；解密时只尝试数据包时间戳对应的窗口，无效包的开销与容差无关
+func WithWindowSlack(n int) Option {
+	return func(c *Crypto) {
+		if n >= 0 {
+			c.windowSlack = n
+		}
+	}
+}
+
+// WithTimestampTolerance 分别设置可接受的时间戳落后量与超前量
+// 已知对端时钟偏快时，可放宽超前、收紧落后，缩小重放录制流量可用的时间范围
+// 两者都不能超过窗口容差覆盖的范围 timeWindow*(windowSlack+1)，需要更大时应同时增大窗口容差
+// 0 表示使用该上限 (与不设置时的对称行为一致)
+func WithTimestampTolerance(past, future time.Duration) Option {
+	return func(c *Crypto) {
+		c.pastTolerance = past
+		c.futureTolerance = future
+	}
+}
+
+// WithAEADRetention 设置 AEAD 缓存保留的过期窗口数
+// 至少为窗口容差 + 1，否则仍可能用到的窗口会被提前清理，小于该值时按最小值处理
+func WithAEADRetention(windows int) Option {
+	return func(c *Crypto) {
+		c.aeadRetention = windows
+	}
+}
+
+// WithSendNonceCacheSize 设置发送端 nonce 缓存的条目上限，超出时淘汰最早的条目
+// 诱使服务端大量加密 (如触发目标持续回包) 也无法让缓存无限增长，0 表示不限制
+func WithSendNonceCacheSize(n int) Option {
+	return func(c *Crypto) {
+		if n >= 0 {
+			c.sendCacheSize = n
+		}
+	}
+}
+
+// WithCipher 选择 AEAD 套件，默认 ChaCha20-Poly1305
+func WithCipher(s Cipher) Option {
+	return func(c *Crypto) {
+		c.cipher = s
+	}
+}
+
+// WithRecvNonceCacheSize 设置接收端 nonce (重放) 缓存的条目上限，超出时淘汰最早的条目，0 表示不限制
+// 条目被淘汰后无法再确认与其同一秒发出的数据包是否为重放，这些数据包会被拒绝，直到这一秒超出时间戳容差；
+// 被淘汰的是最早写入的条目，当前时间发出的数据包不受影响。上限应高于时间戳容差内正常的数据包数
+func WithRecvNonceCacheSize(n int) Option {
+	return func(c *Crypto) {
+		if n >= 0 {
+			c.recvCacheSize = n
+		}
+	}
+}
+
+// WithRand 替换 Nonce 使用的随机源，仅用于测试
+func WithRand(r io.Reader) Option {
+	return func(c *Crypto) {
+		c.random = r
+	}
+}
+
+// randReader GeneratePSK 使用的随机源，测试中可替换
+var randReader io.Reader = rand.Reader
+
+// ErrRandom 随机源读取失败，重试后仍未恢复
+var ErrRandom = errors.New("随机源不可用")
+
+// ErrKey 时间窗口的会话密钥无法派生或无法创建 AEAD，属于本地故障而不是数据包无效
+var ErrKey = errors.New("会话密钥不可用")
+
+const (
+	// randRetries 读取随机源失败后的重试次数，应对熵源的短暂故障
+	randRetries = 3
+	// randRetryBackoff 首次重试前的等待时间，之后每次翻倍
+	randRetryBackoff = time.Millisecond
+)
+
 // New 创建加密器
-func New(pskBase64 string, timeWindow int) (*Crypto, error) {
-	psk, err := base64.StdEncoding.DecodeString(pskBase64)
+func New(pskBase64 string, timeWindow int, opts ...Option) (*Crypto, error) {
+	psk, err := decodePSK(pskBase64)
 	if err != nil {
-		return nil, fmt.Errorf("PSK 解码失败: %w", err)
-	}
-	if len(psk) != PSKSize {
-		return nil, fmt.Errorf("PSK 长度必须是 %d 字节", PSKSize)
+		return nil, err
 	}
 
 	c := &Crypto{
-		psk:        psk,
-		timeWindow: timeWindow,
+		psk:             psk,
+		timeWindow:      timeWindow,
+		cleanupInterval: DefaultCleanupInterval,
+		random:          rand.Reader,
+		windowSlack:     WindowSlack,
+		sendCacheSize:   DefaultSendNonceCacheSize,
+		recvCacheSize:   DefaultRecvNonceCacheSize,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.sendNonceCache = newNonceCache(c.sendCacheSize)
+	c.recvNonceCache = newNonceCache(c.recvCacheSize)
+	if _, ok := cipherLabels[c.cipher]; !ok {
+		return nil, fmt.Errorf("未知的加密套件: %d", c.cipher)
+	}
+	if err := ValidateTimeWindow(timeWindow, c.windowSlack); err != nil {
+		return nil, err
+	}
+	if err := ValidateTimestampTolerance(timeWindow, c.windowSlack, c.pastTolerance, c.futureTolerance); err != nil {
+		return nil, err
+	}
+	maxSkew := time.Duration(timeWindow*(c.windowSlack+1)) * time.Second
+	if c.pastTolerance == 0 {
+		c.pastTolerance = maxSkew
+	}
+	if c.futureTolerance == 0 {
+		c.futureTolerance = maxSkew
+	}
+	if c.aeadRetention < c.windowSlack+1 {
+		c.aeadRetention = c.windowSlack + 1
 	}
 
 	// 派生 UserID
-	reader := hkdf.New(sha256.New, psk, nil, []byte("phantom-userid-v3"))
+	reader := hkdf.New(sha256.New, psk, nil, []byte("phantom-userid-v3"+cipherLabels[c.cipher].suffix))
 	if _, err := io.ReadFull(reader, c.userID[:]); err != nil {
 		return nil, fmt.Errorf("派生 UserID 失败: %w", err)
 	}
@@ -67,6 +277,58 @@ func New(pskBase64 string, timeWindow int) (*Crypto, error) {
 	return c, nil
 }
 
+// ValidatePSK 校验 PSK 格式，不创建加密器
+func ValidatePSK(pskBase64 string) error {
+	_, err := decodePSK(pskBase64)
+	return err
+}
+
+func decodePSK(pskBase64 string) ([]byte, error) {
+	psk, err := base64.StdEncoding.DecodeString(pskBase64)
+	if err != nil {
+		return nil, fmt.Errorf("PSK 解码失败: %w", err)
+	}
+	if len(psk) != PSKSize {
+		return nil, fmt.Errorf("PSK 长度必须是 %d 字节", PSKSize)
+	}
+	return psk, nil
+}
+
+// ValidateTimeWindow 校验时间窗口与窗口容差的组合
+// 时间戳只有 2 字节，可接受的偏差 timeWindow*(windowSlack+1) 一旦超过
+// MaxTimestampSkew，环绕后的差值就会被误判，导致解密莫名失败
+func ValidateTimeWindow(timeWindow, windowSlack int) error {
+	if timeWindow < 1 {
+		return fmt.Errorf("time_window 必须大于 0: %d", timeWindow)
+	}
+	if windowSlack < 0 || windowSlack > MaxWindowSlack {
+		return fmt.Errorf("窗口容差需在 0-%d 之间: %d", MaxWindowSlack, windowSlack)
+	}
+	if skew := int64(timeWindow) * int64(windowSlack+1); skew > MaxTimestampSkew {
+		return fmt.Errorf("time_window(%d 秒) × (窗口容差 %d + 1) = %d 秒，超出 2 字节时间戳可表示的 %d 秒",
+			timeWindow, windowSlack, skew, MaxTimestampSkew)
+	}
+	return nil
+}
+
+// ValidateTimestampTolerance 校验时间戳的落后与超前容差
+// 超出窗口容差覆盖范围的时间戳即使通过校验也找不到对应的密钥窗口，因此不允许
+func ValidateTimestampTolerance(timeWindow, windowSlack int, past, future time.Duration) error {
+	maxSkew := time.Duration(timeWindow*(windowSlack+1)) * time.Second
+	for _, tol := range []struct {
+		name string
+		d    time.Duration
+	}{{"落后", past}, {"超前", future}} {
+		if tol.d < 0 {
+			return fmt.Errorf("时间戳%s容差不能为负数: %v", tol.name, tol.d)
+		}
+		if tol.d > maxSkew {
+			return fmt.Errorf("时间戳%s容差 %v 超出窗口容差覆盖的 %v，需同时增大窗口容差", tol.name, tol.d, maxSkew)
+		}
+	}
+	return nil
+}
+
 // GetUserID 返回 UserID
 func (c *Crypto) GetUserID() [UserIDSize]byte {
 	return c.userID
@@ -74,22 +336,26 @@ func (c *Crypto) GetUserID() [UserIDSize]byte {
 
 // Encrypt 加密数据
 func (c *Crypto) Encrypt(plaintext []byte) ([]byte, error) {
-	window := c.currentWindow()
+	// 窗口与时间戳取自同一时刻，接收端据时间戳即可确定窗口
+	now := c.now()
+	window := now.Unix() / int64(c.timeWindow)
 	aead, err := c.getAEAD(window)
 	if err != nil {
 		return nil, err
 	}
 
-	// 生成唯一 Nonce
-	nonce := make([]byte, NonceSize)
+	// 输出: UserID(4) + Timestamp(2) + Nonce(12) + Ciphertext + Tag(16)
+	output := make([]byte, HeaderSize+NonceSize+len(plaintext)+TagSize)
+	nonce := output[HeaderSize : HeaderSize+NonceSize]
+
+	// 生成唯一 Nonce，直接写入输出缓冲
 	for attempts := 0; attempts < 10; attempts++ {
-		if _, err := rand.Read(nonce); err != nil {
+		if err := readRandom(c.random, nonce); err != nil {
 			return nil, err
 		}
-		
+
 		// 确保这个 nonce 没有被发送过
-		nonceKey := string(nonce)
-		if _, exists := c.sendNonceCache.LoadOrStore(nonceKey, time.Now()); !exists {
+		if c.sendNonceCache.add(nonceKey(nonce), c.now()) {
 			break // 找到了唯一的 nonce
 		}
 		if attempts == 9 {
@@ -97,13 +363,10 @@ func (c *Crypto) Encrypt(plaintext []byte) ([]byte, error) {
 		}
 	}
 
-	timestamp := uint16(time.Now().Unix() & 0xFFFF)
+	timestamp := uint16(now.Unix() & 0xFFFF)
 
-	// 输出: UserID(4) + Timestamp(2) + Nonce(12) + Ciphertext + Tag(16)
-	output := make([]byte, HeaderSize+NonceSize+len(plaintext)+TagSize)
 	copy(output[:UserIDSize], c.userID[:])
 	binary.BigEndian.PutUint16(output[UserIDSize:HeaderSize], timestamp)
-	copy(output[HeaderSize:HeaderSize+NonceSize], nonce)
 
 	// AAD = Header, Seal 会追加密文到 dst
 	aead.Seal(output[HeaderSize+NonceSize:HeaderSize+NonceSize], nonce, plaintext, output[:HeaderSize])
@@ -126,45 +389,136 @@ func (c *Crypto) Decrypt(data []byte) ([]byte, error) {
 	}
 
 	// 验证时间戳
-	timestamp := binary.BigEndian.Uint16(data[UserIDSize:HeaderSize])
-	if !c.validateTimestamp(timestamp) {
+	now := c.now()
+	skew := c.timestampSkew(binary.BigEndian.Uint16(data[UserIDSize:HeaderSize]), now)
+	if !c.skewAllowed(skew) {
 		return nil, fmt.Errorf("时间戳无效")
 	}
+	// 发送时间由时间戳还原到秒，同一数据包每次还原的结果相同
+	sentAt := time.Unix(now.Unix()+int64(skew), 0)
 
 	nonce := data[HeaderSize : HeaderSize+NonceSize]
-	nonceKey := string(nonce)
+	key := nonceKey(nonce)
 
 	// 重放检查：只检查接收缓存
-	if _, exists := c.recvNonceCache.Load(nonceKey); exists {
-		return nil, fmt.Errorf("重放攻击")
+	if !c.replayDisabled {
+		if c.recvNonceCache.contains(key) {
+			return nil, fmt.Errorf("重放攻击")
+		}
+		if c.recvNonceCache.evictedAt(sentAt) {
+			return nil, fmt.Errorf("重放缓存已满，无法确认是否为重放")
+		}
 	}
 
 	ciphertext := data[HeaderSize+NonceSize:]
 	header := data[:HeaderSize]
 
-	// 尝试多个时间窗口
-	for _, window := range c.validWindows() {
+	// 尝试时间戳对应的窗口；某个窗口的密钥不可用时继续尝试其他窗口，都失败时报告密钥错误
+	var keyErr error
+	current := now.Unix() / int64(c.timeWindow)
+	for _, window := range c.candidateWindows(current, sentAt) {
 		aead, err := c.getAEAD(window)
 		if err != nil {
+			keyErr = err
 			continue
 		}
 		if plaintext, err := aead.Open(nil, nonce, ciphertext, header); err == nil {
-			// 解密成功后才记录 nonce
-			c.recvNonceCache.Store(nonceKey, time.Now())
+			// 解密成功后才记录 nonce；并发解密同一数据包时只有一个能写入
+			if !c.replayDisabled && !c.recvNonceCache.add(key, sentAt) {
+				return nil, fmt.Errorf("重放攻击")
+			}
+			c.recordWindowHit(int(window - current))
 			return plaintext, nil
 		}
 	}
 
+	if keyErr != nil {
+		return nil, keyErr
+	}
 	return nil, fmt.Errorf("解密失败")
 }
 
+// WindowStats 解密成功的数据包所在时间窗口的分布
+// 健康的部署几乎全部落在 Current；Previous 或 Next 偏多说明客户端与服务端时钟有偏差
+type WindowStats struct {
+	Previous int64 `json:"previous"` // w-1
+	Current  int64 `json:"current"`  // w
+	Next     int64 `json:"next"`     // w+1
+	Other    int64 `json:"other"`    // 偏差超过 1 个窗口，仅在容差大于 1 时出现
+}
+
+// WindowStats 返回解密成功的数据包在各时间窗口上的计数
+func (c *Crypto) WindowStats() WindowStats {
+	return WindowStats{
+		Previous: c.windowHits[0].Load(),
+		Current:  c.windowHits[1].Load(),
+		Next:     c.windowHits[2].Load(),
+		Other:    c.windowOther.Load(),
+	}
+}
+
+// recordWindowHit 记录一次解密成功，offset 为所在窗口相对当前窗口的偏移
+func (c *Crypto) recordWindowHit(offset int) {
+	if offset >= -1 && offset <= 1 {
+		c.windowHits[offset+1].Add(1)
+		return
+	}
+	c.windowOther.Add(1)
+}
+
+// CachedWindows 返回当前已派生并缓存 AEAD 的时间窗口，按升序排列
+// 用于排查密钥派生与缓存清理问题
+func (c *Crypto) CachedWindows() []int64 {
+	var windows []int64
+	c.aeadCache.Range(func(key, _ interface{}) bool {
+		if w, ok := key.(int64); ok {
+			windows = append(windows, w)
+		}
+		return true
+	})
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return windows
+}
+
+// CacheStats nonce 缓存的统计信息
+// RecvEvicted 持续增长说明接收缓存上限不足或正在遭受洪泛，期间部分数据包会被拒绝
+type CacheStats struct {
+	RecvEntries int   `json:"recv_entries"`
+	RecvEvicted int64 `json:"recv_evicted"`
+	SendEntries int   `json:"send_entries"`
+	SendEvicted int64 `json:"send_evicted"`
+}
+
+// CacheStats 返回 nonce 缓存的当前大小与淘汰次数，用于监控内存增长
+func (c *Crypto) CacheStats() CacheStats {
+	return CacheStats{
+		RecvEntries: c.recvNonceCache.len(),
+		RecvEvicted: c.recvNonceCache.evictions(),
+		SendEntries: c.sendNonceCache.len(),
+		SendEvicted: c.sendNonceCache.evictions(),
+	}
+}
+
 func (c *Crypto) currentWindow() int64 {
-	return time.Now().Unix() / int64(c.timeWindow)
+	return c.now().Unix() / int64(c.timeWindow)
 }
 
-func (c *Crypto) validWindows() []int64 {
-	w := c.currentWindow()
-	return []int64{w - 1, w, w + 1}
+// candidateWindows 返回发送时间 sentAt 对应的密钥窗口，不在 current 前后窗口容差内的不返回
+// 旧版本的发送端先取窗口再取时间戳，两次取时间之间跨过窗口边界时时间戳会落在下一个窗口，
+// 因此发送时间恰好是窗口的第一秒时也尝试前一个窗口；每个数据包最多尝试两个窗口
+func (c *Crypto) candidateWindows(current int64, sentAt time.Time) []int64 {
+	tw := int64(c.timeWindow)
+	sec := sentAt.Unix()
+	windows := make([]int64, 0, 2)
+	for _, w := range []int64{sec / tw, (sec - 1) / tw} {
+		if len(windows) > 0 && windows[len(windows)-1] == w {
+			continue
+		}
+		if w >= current-int64(c.windowSlack) && w <= current+int64(c.windowSlack) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
 }
 
 func (c *Crypto) getAEAD(window int64) (cipher.AEAD, error) {
@@ -175,23 +529,63 @@ func (c *Crypto) getAEAD(window int64) (cipher.AEAD, error) {
 	// 派生密钥
 	salt := make([]byte, 8)
 	binary.BigEndian.PutUint64(salt, uint64(window))
-	reader := hkdf.New(sha256.New, c.psk, salt, []byte("phantom-key-v3"))
-	key := make([]byte, chacha20poly1305.KeySize)
-	if _, err := io.ReadFull(reader, key); err != nil {
-		return nil, fmt.Errorf("派生密钥失败: %w", err)
+	// 两种套件的密钥都是 32 字节
+	key, err := deriveKey(c.psk, salt, "phantom-key-v3"+cipherLabels[c.cipher].suffix, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 派生密钥失败: %v", ErrKey, err)
 	}
 
-	aead, err := chacha20poly1305.New(key)
+	aead, err := newAEAD(c.cipher, key)
 	if err != nil {
-		return nil, fmt.Errorf("创建 AEAD 失败: %w", err)
+		return nil, fmt.Errorf("%w: 创建 AEAD 失败: %v", ErrKey, err)
 	}
 	c.aeadCache.Store(window, aead)
 	return aead, nil
 }
 
-func (c *Crypto) validateTimestamp(ts uint16) bool {
-	current := uint16(time.Now().Unix() & 0xFFFF)
-	diff := int(current) - int(ts)
+// deriveKey 用 HKDF 从 secret 派生 size 字节的密钥，测试中可替换以模拟派生失败
+var deriveKey = func(secret, salt []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newAEAD 按套件创建 AEAD，两种套件的 nonce 均为 12 字节、tag 均为 16 字节
+func newAEAD(s Cipher, key []byte) (cipher.AEAD, error) {
+	if s == CipherAES256GCM {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// CheckTimestamp 只校验头部的 UserID 和时间戳（不做 AEAD 解密），
+// 返回对端时钟相对本机的偏差（正数表示对端时钟较快）以及是否在可接受范围内
+// 用于轻量的时钟偏差诊断
+func (c *Crypto) CheckTimestamp(data []byte) (skew time.Duration, ok bool, err error) {
+	if len(data) < HeaderSize {
+		return 0, false, fmt.Errorf("数据太短")
+	}
+
+	var userID [UserIDSize]byte
+	copy(userID[:], data[:UserIDSize])
+	if userID != c.userID {
+		return 0, false, fmt.Errorf("UserID 不匹配")
+	}
+
+	diff := c.timestampSkew(binary.BigEndian.Uint16(data[UserIDSize:HeaderSize]), c.now())
+	return time.Duration(diff) * time.Second, c.skewAllowed(diff), nil
+}
+
+// timestampSkew 返回时间戳相对 now 的偏差（秒），正数表示时间戳超前
+func (c *Crypto) timestampSkew(ts uint16, now time.Time) int {
+	current := uint16(now.Unix() & 0xFFFF)
+	diff := int(ts) - int(current)
 
 	// 处理环绕
 	if diff < -32768 {
@@ -199,53 +593,67 @@ func (c *Crypto) validateTimestamp(ts uint16) bool {
 	} else if diff > 32768 {
 		diff -= 65536
 	}
-	if diff < 0 {
-		diff = -diff
-	}
+	return diff
+}
 
-	return diff <= c.timeWindow*2
+func (c *Crypto) skewAllowed(diff int) bool {
+	skew := time.Duration(diff) * time.Second
+	if skew < 0 {
+		return -skew <= c.pastTolerance
+	}
+	return skew <= c.futureTolerance
 }
 
 func (c *Crypto) cleanupLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(c.cleanupInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		now := time.Now()
-		cw := c.currentWindow()
-		expireTime := 2 * time.Minute
-
-		// 清理接收 nonce 缓存
-		c.recvNonceCache.Range(func(key, value interface{}) bool {
-			if t, ok := value.(time.Time); ok && now.Sub(t) > expireTime {
-				c.recvNonceCache.Delete(key)
-			}
-			return true
-		})
+		c.cleanup()
+	}
+}
 
-		// 清理发送 nonce 缓存
-		c.sendNonceCache.Range(func(key, value interface{}) bool {
-			if t, ok := value.(time.Time); ok && now.Sub(t) > expireTime {
-				c.sendNonceCache.Delete(key)
-			}
-			return true
-		})
+func (c *Crypto) cleanup() {
+	now := c.now()
+	cw := c.currentWindow()
+	expireTime := 2 * time.Minute
 
-		// 清理 AEAD 缓存
-		c.aeadCache.Range(func(key, value interface{}) bool {
-			if w, ok := key.(int64); ok && cw-w > 2 {
-				c.aeadCache.Delete(key)
-			}
-			return true
-		})
+	// 清理接收 nonce 缓存：发送时间超出落后容差的数据包会被时间戳校验拒绝，无需再记录
+	c.recvNonceCache.expire(now.Add(-max(expireTime, c.pastTolerance+time.Second)))
+
+	// 清理发送 nonce 缓存
+	c.sendNonceCache.expire(now.Add(-expireTime))
+
+	// 清理 AEAD 缓存
+	c.aeadCache.Range(func(key, value interface{}) bool {
+		if w, ok := key.(int64); ok && cw-w > int64(c.aeadRetention) {
+			c.aeadCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// readRandom 从 r 读满 b，失败时退避重试，仍失败则返回包装了 ErrRandom 的错误
+func readRandom(r io.Reader, b []byte) error {
+	backoff := randRetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if _, err = io.ReadFull(r, b); err == nil {
+			return nil
+		}
+		if attempt == randRetries {
+			return fmt.Errorf("%w: 重试 %d 次后仍失败: %v", ErrRandom, randRetries, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 }
 
 // GeneratePSK 生成新的 PSK
 func GeneratePSK() (string, error) {
 	psk := make([]byte, PSKSize)
-	if _, err := rand.Read(psk); err != nil {
-		return "", err
+	if err := readRandom(randReader, psk); err != nil {
+		return "", fmt.Errorf("生成 PSK 失败，请检查系统熵源 (如 /dev/urandom 是否可读): %w", err)
 	}
 	return base64.StdEncoding.EncodeToString(psk), nil
 }
@@ -1,7 +1,15 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGeneratePSK(t *testing.T) {
@@ -123,6 +131,50 @@ func TestInvalidPSK(t *testing.T) {
 	}
 }
 
+func TestCipherSuites(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	suites := []Cipher{CipherChaCha20Poly1305, CipherAES256GCM}
+	cryptos := make([]*Crypto, len(suites))
+	for i, suite := range suites {
+		if cryptos[i], err = New(psk, 30, WithCipher(suite)); err != nil {
+			t.Fatalf("创建 %v 失败: %v", suite, err)
+		}
+		peer, _ := New(psk, 30, WithCipher(suite))
+		encrypted, err := peer.Encrypt([]byte("suite"))
+		if err != nil {
+			t.Fatalf("%v 加密失败: %v", suite, err)
+		}
+		if plaintext, err := cryptos[i].Decrypt(encrypted); err != nil || string(plaintext) != "suite" {
+			t.Errorf("%v 往返失败: %v", suite, err)
+		}
+	}
+
+	// 套件不一致时 UserID 不同，直接拒绝
+	encrypted, _ := cryptos[0].Encrypt([]byte("suite"))
+	if _, err := cryptos[1].Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "UserID") {
+		t.Errorf("套件不一致应在 UserID 校验时被拒绝: %v", err)
+	}
+
+	for _, suite := range suites {
+		if got, err := ParseCipher(suite.String()); err != nil || got != suite {
+			t.Errorf("ParseCipher(%q) = %v, %v", suite, got, err)
+		}
+	}
+	if got, err := ParseCipher(""); err != nil || got != CipherChaCha20Poly1305 {
+		t.Errorf("空名称应为默认套件: %v %v", got, err)
+	}
+	if _, err := ParseCipher("aes-128-cbc"); err == nil {
+		t.Error("未知套件应返回错误")
+	}
+	if _, err := New(psk, 30, WithCipher(Cipher(9))); err == nil {
+		t.Error("未知套件应拒绝创建")
+	}
+}
+
 func BenchmarkEncrypt(b *testing.B) {
 	psk, err := GeneratePSK()
 	if err != nil {
@@ -165,3 +217,804 @@ func BenchmarkDecrypt(b *testing.B) {
 		_, _ = c.Decrypt(encrypted)
 	}
 }
+
+func TestTimeWindowTooLarge(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	// 20000 * (1 + 1) 秒超出 2 字节时间戳的表示范围
+	_, err = New(psk, 20000)
+	if err == nil {
+		t.Fatal("过大的时间窗口应该被拒绝")
+	}
+	if !strings.Contains(err.Error(), "时间戳") {
+		t.Errorf("错误信息不够明确: %v", err)
+	}
+
+	if err := ValidateTimeWindow(300, WindowSlack); err != nil {
+		t.Errorf("合法组合被拒绝: %v", err)
+	}
+	if err := ValidateTimeWindow(10000, 3); err == nil {
+		t.Error("时间窗口与容差的组合超限应该被拒绝")
+	}
+	if err := ValidateTimeWindow(0, WindowSlack); err == nil {
+		t.Error("时间窗口为 0 应该被拒绝")
+	}
+	if err := ValidateTimeWindow(1, MaxWindowSlack+1); err == nil {
+		t.Error("窗口容差超过上限应该被拒绝")
+	}
+}
+
+// TestDecryptCandidateWindows 无效数据包只按时间戳尝试对应的窗口，开销与窗口容差无关
+func TestDecryptCandidateWindows(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	now := time.Unix(1_700_000_005, 0)
+	clock := WithClock(func() time.Time { return now })
+	server, err := New(psk, 1, clock, WithWindowSlack(MaxWindowSlack))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	client, err := New(psk, 1, WithClock(func() time.Time { return now.Add(-3 * time.Second) }))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	packet, err := client.Encrypt([]byte("junk"))
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	packet[len(packet)-1] ^= 0xFF
+	if _, err := server.Decrypt(packet); err == nil {
+		t.Fatal("篡改的数据包应解密失败")
+	}
+	if windows := server.CachedWindows(); len(windows) > 2 {
+		t.Errorf("无效数据包尝试了 %d 个窗口: %v", len(windows), windows)
+	}
+
+	// 容差内偏差的数据包仍能解密
+	packet[len(packet)-1] ^= 0xFF
+	if plaintext, err := server.Decrypt(packet); err != nil || string(plaintext) != "junk" {
+		t.Errorf("偏差 3 个窗口的数据包解密失败: %v", err)
+	}
+	if stats := server.WindowStats(); stats.Other != 1 {
+		t.Errorf("窗口统计错误: %+v", stats)
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	c, err := New(psk, 30, WithCleanupInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 放入一个早已过期的 nonce
+	c.recvNonceCache.add(nonceKey{1}, time.Now().Add(-10*time.Minute))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if !c.recvNonceCache.contains(nonceKey{1}) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("过期 nonce 未被及时清理")
+}
+
+func TestDisableReplayProtection(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	c, err := New(psk, 30, WithDisableReplayProtection(true))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	encrypted, err := c.Encrypt([]byte("idempotent"))
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := c.Decrypt(encrypted); err != nil {
+			t.Fatalf("关闭重放检测后第 %d 次解密失败: %v", i+1, err)
+		}
+	}
+
+	// 接收缓存不应增长
+	if n := c.CacheStats().RecvEntries; n != 0 {
+		t.Fatalf("关闭重放检测后不应记录 nonce: %d", n)
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	c, err := New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	header := func(offset int64) []byte {
+		data := make([]byte, HeaderSize)
+		userID := c.GetUserID()
+		copy(data, userID[:])
+		binary.BigEndian.PutUint16(data[UserIDSize:], uint16((time.Now().Unix()+offset)&0xFFFF))
+		return data
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{"窗口内", 5, true},
+		{"时钟超前", 100, false},
+		{"时钟落后", -100, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skew, ok, err := c.CheckTimestamp(header(tt.offset))
+			if err != nil {
+				t.Fatalf("校验失败: %v", err)
+			}
+			if ok != tt.ok {
+				t.Errorf("ok 错误: got %v, want %v", ok, tt.ok)
+			}
+			want := time.Duration(tt.offset) * time.Second
+			if d := skew - want; d < -time.Second || d > time.Second {
+				t.Errorf("偏差错误: got %v, want %v", skew, want)
+			}
+		})
+	}
+
+	if _, _, err := c.CheckTimestamp([]byte{1, 2}); err == nil {
+		t.Error("过短的数据应该返回错误")
+	}
+}
+
+func TestTimestampTolerance(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	now := time.Unix(1700000010, 0) // 窗口起点，+40 秒恰好落在下一个窗口
+	server, err := New(psk, 30, WithClock(func() time.Time { return now }),
+		WithTimestampTolerance(10*time.Second, 50*time.Second))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		ok     bool
+	}{
+		{"超前在容差内", 40, true},
+		{"超前超出容差", 55, false},
+		{"落后在容差内", -5, true},
+		{"落后超出容差", -40, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := New(psk, 30, WithClock(func() time.Time { return now.Add(time.Duration(tt.offset) * time.Second) }))
+			if err != nil {
+				t.Fatalf("创建 Crypto 失败: %v", err)
+			}
+			encrypted, err := client.Encrypt([]byte("skew"))
+			if err != nil {
+				t.Fatalf("加密失败: %v", err)
+			}
+			if _, ok, _ := server.CheckTimestamp(encrypted); ok != tt.ok {
+				t.Errorf("CheckTimestamp ok = %v, want %v", ok, tt.ok)
+			}
+			if _, err := server.Decrypt(encrypted); (err == nil) != tt.ok {
+				t.Errorf("Decrypt err = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+
+	// 超出窗口容差覆盖范围的容差无法生效，应拒绝
+	if _, err := New(psk, 30, WithTimestampTolerance(0, 61*time.Second)); err == nil {
+		t.Error("超前容差超过 timeWindow*(windowSlack+1) 应返回错误")
+	}
+	if _, err := New(psk, 30, WithWindowSlack(2), WithTimestampTolerance(0, 61*time.Second)); err != nil {
+		t.Errorf("增大窗口容差后应允许: %v", err)
+	}
+	if _, err := New(psk, 30, WithTimestampTolerance(-time.Second, 0)); err == nil {
+		t.Error("负数容差应返回错误")
+	}
+}
+
+// repeatReader 按顺序返回预设的 nonce，用完后一直返回最后一个
+type repeatReader struct {
+	nonces [][]byte
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.nonces[0])
+	if len(r.nonces) > 1 {
+		r.nonces = r.nonces[1:]
+	}
+	return n, nil
+}
+
+func TestNonceCollision(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	a := bytes.Repeat([]byte{0xAA}, NonceSize)
+	b := bytes.Repeat([]byte{0xBB}, NonceSize)
+
+	// 第二次加密先拿到重复的 A，应重试并改用 B
+	c, err := New(psk, 30, WithRand(&repeatReader{nonces: [][]byte{a, a, b}}))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	first, err := c.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatalf("首次加密失败: %v", err)
+	}
+	second, err := c.Encrypt([]byte("second"))
+	if err != nil {
+		t.Fatalf("重试后加密应该成功: %v", err)
+	}
+	if !bytes.Equal(first[HeaderSize:HeaderSize+NonceSize], a) || !bytes.Equal(second[HeaderSize:HeaderSize+NonceSize], b) {
+		t.Error("Nonce 去重重试结果错误")
+	}
+
+	// 随机源一直返回同一个 nonce，重试耗尽后应报错
+	c, err = New(psk, 30, WithRand(&repeatReader{nonces: [][]byte{a}}))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	if _, err := c.Encrypt([]byte("first")); err != nil {
+		t.Fatalf("首次加密失败: %v", err)
+	}
+	if _, err := c.Encrypt([]byte("second")); err == nil {
+		t.Fatal("无法生成唯一 Nonce 时应该报错")
+	}
+}
+
+func TestGeneratePSKDeterministic(t *testing.T) {
+	old := randReader
+	randReader = bytes.NewReader(bytes.Repeat([]byte{0x01}, PSKSize))
+	defer func() { randReader = old }()
+
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	if want := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x01}, PSKSize)); psk != want {
+		t.Errorf("PSK 错误: got %s, want %s", psk, want)
+	}
+}
+
+// flakyReader 前 failures 次读取失败，之后从 crypto/rand 读取
+type flakyReader struct {
+	failures int
+	reads    int
+}
+
+func (r *flakyReader) Read(b []byte) (int, error) {
+	r.reads++
+	if r.reads <= r.failures {
+		return 0, errors.New("熵源暂时不可用")
+	}
+	return rand.Read(b)
+}
+
+func TestRandomRetry(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	// 短暂故障在重试内恢复
+	flaky := &flakyReader{failures: randRetries}
+	c, err := New(psk, 30, WithRand(flaky))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	encrypted, err := c.Encrypt([]byte("retry"))
+	if err != nil {
+		t.Fatalf("短暂的随机源故障应被重试: %v", err)
+	}
+	if plaintext, err := c.Decrypt(encrypted); err != nil || string(plaintext) != "retry" {
+		t.Fatalf("重试后加密的数据无法解密: %v", err)
+	}
+	if flaky.reads != randRetries+1 {
+		t.Errorf("读取次数 = %d, 期望 %d", flaky.reads, randRetries+1)
+	}
+
+	// 持续故障只让这一条消息失败
+	c, err = New(psk, 30, WithRand(&flakyReader{failures: randRetries + 1}))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	if _, err := c.Encrypt([]byte("fail")); !errors.Is(err, ErrRandom) {
+		t.Fatalf("持续故障应返回 ErrRandom: %v", err)
+	}
+	if _, err := c.Encrypt([]byte("next")); err != nil {
+		t.Errorf("随机源恢复后加密应成功: %v", err)
+	}
+
+	old := randReader
+	randReader = &flakyReader{failures: 100}
+	defer func() { randReader = old }()
+	if _, err := GeneratePSK(); !errors.Is(err, ErrRandom) || !strings.Contains(err.Error(), "熵源") {
+		t.Errorf("GeneratePSK 应返回可操作的错误: %v", err)
+	}
+}
+
+func TestKeyDerivationError(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	client, err := New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	packet, err := client.Encrypt([]byte("key"))
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+
+	// 服务端的会话密钥全部无法派生：加解密都应返回 ErrKey，而不是普通的解密失败
+	old := deriveKey
+	deriveKey = func([]byte, []byte, string, int) ([]byte, error) { return nil, errors.New("hkdf 故障") }
+	defer func() { deriveKey = old }()
+	server, err := New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	if _, err := server.Encrypt([]byte("key")); !errors.Is(err, ErrKey) {
+		t.Errorf("加密应返回 ErrKey: %v", err)
+	}
+	if _, err := server.Decrypt(packet); !errors.Is(err, ErrKey) {
+		t.Errorf("解密应返回 ErrKey: %v", err)
+	}
+
+	// 无效数据包在密钥可用时仍是普通的解密失败
+	deriveKey = old
+	packet[len(packet)-1] ^= 0xFF
+	if _, err := server.Decrypt(packet); err == nil || errors.Is(err, ErrKey) {
+		t.Errorf("篡改的数据包应返回普通的解密失败: %v", err)
+	}
+}
+
+func TestCachedWindows(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	c, err := New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	cw := c.currentWindow()
+	if _, err := c.Encrypt([]byte("current")); err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	// 上一个窗口的 AEAD 在解密落后的数据包时派生
+	if _, err := c.getAEAD(cw - 1); err != nil {
+		t.Fatalf("派生上一窗口失败: %v", err)
+	}
+
+	windows := c.CachedWindows()
+	if len(windows) != 2 || windows[0] != cw-1 || windows[1] != cw {
+		t.Errorf("缓存窗口错误: %v, 当前窗口 %d", windows, cw)
+	}
+}
+
+func FuzzDecrypt(f *testing.F) {
+	psk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, PSKSize))
+	// 关闭重放保护，否则同一输入第二次执行就会被当作重放拒绝
+	c, err := New(psk, 30, WithDisableReplayProtection(true))
+	if err != nil {
+		f.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 以合法密文为种子，让模糊测试从接近合法的输入开始变异
+	for _, seed := range [][]byte{nil, []byte("a"), []byte("Hello, Phantom!"), bytes.Repeat([]byte{0xFF}, 1024)} {
+		encrypted, err := c.Encrypt(seed)
+		if err != nil {
+			f.Fatalf("加密失败: %v", err)
+		}
+		f.Add(encrypted)
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		plaintext, err := c.Decrypt(data)
+		if err != nil {
+			return
+		}
+		if want := len(data) - HeaderSize - NonceSize - TagSize; len(plaintext) != want {
+			t.Fatalf("明文长度错误: %d != %d", len(plaintext), want)
+		}
+		encrypted, err := c.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("重新加密失败: %v", err)
+		}
+		again, err := c.Decrypt(encrypted)
+		if err != nil || !bytes.Equal(again, plaintext) {
+			t.Fatalf("重新加密后往返失败: %v", err)
+		}
+	})
+}
+
+func TestAEADRetention(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	base := time.Unix(1_700_000_000, 0)
+	client, err := New(psk, 1)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	client.now = func() time.Time { return base }
+
+	// 保留窗口数小于容差 + 1 时按最小值处理
+	c, err := New(psk, 1, WithWindowSlack(4), WithAEADRetention(1))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	if c.aeadRetention != 5 {
+		t.Fatalf("保留窗口数应至少为容差 + 1: %d", c.aeadRetention)
+	}
+
+	now := base
+	c.now = func() time.Time { return now }
+
+	first, err := client.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	if _, err := c.Decrypt(first); err != nil {
+		t.Fatalf("解密失败: %v", err)
+	}
+
+	// 服务端时钟前进 4 个窗口后清理，旧窗口仍在容差内，不应被清理
+	now = base.Add(4 * time.Second)
+	c.cleanup()
+	cached := func(window int64) bool {
+		for _, w := range c.CachedWindows() {
+			if w == window {
+				return true
+			}
+		}
+		return false
+	}
+	if !cached(base.Unix()) {
+		t.Fatalf("容差内的旧窗口被提前清理: %v", c.CachedWindows())
+	}
+
+	skewed, err := client.Encrypt([]byte("skewed"))
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	if plaintext, err := c.Decrypt(skewed); err != nil || string(plaintext) != "skewed" {
+		t.Fatalf("解密偏差 4 秒的数据包失败: %v", err)
+	}
+
+	// 超出保留范围后被清理
+	now = base.Add(10 * time.Second)
+	c.cleanup()
+	if cached(base.Unix()) {
+		t.Errorf("超出保留范围的窗口应被清理: %v", c.CachedWindows())
+	}
+}
+
+func TestWindowStats(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	// 取窗口中间的时刻，避免偏移后落在窗口边界上
+	base := time.Unix(1_700_000_005, 0)
+	server, err := New(psk, 10)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	server.now = func() time.Time { return base }
+
+	send := func(offset time.Duration, n int) {
+		client, err := New(psk, 10)
+		if err != nil {
+			t.Fatalf("创建 Crypto 失败: %v", err)
+		}
+		client.now = func() time.Time { return base.Add(offset) }
+		for i := 0; i < n; i++ {
+			encrypted, err := client.Encrypt([]byte("skew"))
+			if err != nil {
+				t.Fatalf("加密失败: %v", err)
+			}
+			if _, err := server.Decrypt(encrypted); err != nil {
+				t.Fatalf("时钟偏差 %v 的数据包解密失败: %v", offset, err)
+			}
+		}
+	}
+	send(-10*time.Second, 2) // 客户端时钟落后一个窗口
+	send(0, 5)
+	send(10*time.Second, 3) // 客户端时钟超前一个窗口
+
+	// 解密失败不计入分布
+	server.Decrypt(make([]byte, HeaderSize+NonceSize+TagSize))
+
+	want := WindowStats{Previous: 2, Current: 5, Next: 3}
+	if got := server.WindowStats(); got != want {
+		t.Errorf("窗口分布 = %+v, 期望 %+v", got, want)
+	}
+
+	// 容差大于 1 时，更远的窗口计入 Other
+	wide, err := New(psk, 10, WithWindowSlack(2))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	wide.now = func() time.Time { return base }
+	client, _ := New(psk, 10)
+	client.now = func() time.Time { return base.Add(-20 * time.Second) }
+	encrypted, _ := client.Encrypt([]byte("far"))
+	if _, err := wide.Decrypt(encrypted); err != nil {
+		t.Fatalf("解密失败: %v", err)
+	}
+	if got := wide.WindowStats(); got != (WindowStats{Other: 1}) {
+		t.Errorf("窗口分布 = %+v, 期望 Other=1", got)
+	}
+}
+
+// BenchmarkNonceDedup 对比 Encrypt 发送端 nonce 去重的两种实现
+// syncmap 为原先 sync.Map + string(nonce) 的做法，留作对照
+// BenchmarkDecryptCipher 比较两种套件的解密开销 (不含加密与重放检测)
+func BenchmarkDecryptCipher(b *testing.B) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		b.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	for _, suite := range []Cipher{CipherChaCha20Poly1305, CipherAES256GCM} {
+		b.Run(suite.String(), func(b *testing.B) {
+			c, err := New(psk, 30, WithCipher(suite), WithDisableReplayProtection(true))
+			if err != nil {
+				b.Fatalf("创建 Crypto 失败: %v", err)
+			}
+			encrypted, err := c.Encrypt(make([]byte, 1024))
+			if err != nil {
+				b.Fatalf("加密失败: %v", err)
+			}
+
+			b.SetBytes(1024)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Decrypt(encrypted); err != nil {
+					b.Fatalf("解密失败: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNonceDedup(b *testing.B) {
+	nonce := make([]byte, NonceSize)
+
+	b.Run("syncmap", func(b *testing.B) {
+		var cache sync.Map
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			binary.BigEndian.PutUint64(nonce, uint64(i))
+			cache.LoadOrStore(string(nonce), time.Now())
+		}
+	})
+
+	b.Run("nonceCache", func(b *testing.B) {
+		cache := newNonceCache(0)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			binary.BigEndian.PutUint64(nonce, uint64(i))
+			cache.add(nonceKey(nonce), time.Now())
+		}
+	})
+}
+
+func TestSendNonceCacheBounded(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	const limit = 100
+	c, err := New(psk, 30, WithSendNonceCacheSize(limit))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	for i := 0; i < 10*limit; i++ {
+		if _, err := c.Encrypt([]byte("flood")); err != nil {
+			t.Fatalf("加密失败: %v", err)
+		}
+		if n := c.CacheStats().SendEntries; n > limit {
+			t.Fatalf("缓存超出上限: %d > %d", n, limit)
+		}
+	}
+	if stats := c.CacheStats(); stats.SendEntries != limit || stats.SendEvicted != 9*limit {
+		t.Errorf("缓存统计错误: %+v", stats)
+	}
+}
+
+func TestRecvNonceCacheBounded(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	clock := WithClock(func() time.Time { return now })
+	const limit = 100
+	server, err := New(psk, 30, clock, WithRecvNonceCacheSize(limit))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	client, err := New(psk, 30, clock)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	encrypt := func() []byte {
+		t.Helper()
+		packet, err := client.Encrypt([]byte("flood"))
+		if err != nil {
+			t.Fatalf("加密失败: %v", err)
+		}
+		return packet
+	}
+
+	// 填满缓存后再多一个，淘汰最早的条目
+	first := encrypt()
+	if _, err := server.Decrypt(first); err != nil {
+		t.Fatalf("解密失败: %v", err)
+	}
+	for i := 0; i < limit; i++ {
+		if _, err := server.Decrypt(encrypt()); err != nil {
+			t.Fatalf("第 %d 个数据包解密失败: %v", i, err)
+		}
+	}
+	if stats := server.CacheStats(); stats.RecvEntries != limit || stats.RecvEvicted != 1 {
+		t.Fatalf("缓存统计错误: %+v", stats)
+	}
+
+	// 被淘汰的 nonce 无法再判断是否重放，同一时间发出的数据包一律拒绝
+	if _, err := server.Decrypt(first); err == nil {
+		t.Fatal("被淘汰的 nonce 重放后应被拒绝")
+	}
+	if _, err := server.Decrypt(encrypt()); err == nil {
+		t.Fatal("缓存已满时与被淘汰条目同一时间的数据包应被拒绝")
+	}
+
+	// 更晚发出的数据包不受影响
+	now = now.Add(time.Second)
+	if _, err := server.Decrypt(encrypt()); err != nil {
+		t.Fatalf("更晚的数据包解密失败: %v", err)
+	}
+	if n := server.CacheStats().RecvEntries; n != limit {
+		t.Errorf("缓存超出上限: %d", n)
+	}
+}
+
+// TestRecvNonceCacheSkewedClient 时钟超前的客户端的条目被淘汰后，时钟正常的客户端在持续淘汰下仍能正常收发
+func TestRecvNonceCacheSkewedClient(t *testing.T) {
+	psk, err := GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	const limit = 50
+	server, err := New(psk, 30, WithClock(func() time.Time { return now }), WithRecvNonceCacheSize(limit))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	skewed, err := New(psk, 30, WithClock(func() time.Time { return now.Add(20 * time.Second) }))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	client, err := New(psk, 30, WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	encrypt := func(c *Crypto) []byte {
+		t.Helper()
+		packet, err := c.Encrypt([]byte("flood"))
+		if err != nil {
+			t.Fatalf("加密失败: %v", err)
+		}
+		return packet
+	}
+
+	// 超前的客户端先填满缓存
+	var skewedPackets [][]byte
+	for i := 0; i < limit; i++ {
+		packet := encrypt(skewed)
+		if _, err := server.Decrypt(packet); err != nil {
+			t.Fatalf("超前客户端的数据包解密失败: %v", err)
+		}
+		skewedPackets = append(skewedPackets, packet)
+	}
+
+	// 每秒写入缓存上限的一半，持续淘汰更早的条目，时钟正常的客户端不受影响
+	for sec := 0; sec < 10; sec++ {
+		now = now.Add(time.Second)
+		for i := 0; i < limit/2; i++ {
+			if _, err := server.Decrypt(encrypt(client)); err != nil {
+				t.Fatalf("第 %d 秒第 %d 个数据包解密失败: %v", sec, i, err)
+			}
+		}
+	}
+	if stats := server.CacheStats(); stats.RecvEntries != limit || stats.RecvEvicted != 5*limit {
+		t.Fatalf("缓存统计错误: %+v", stats)
+	}
+
+	// 被淘汰的超前数据包重放仍被拒绝
+	if _, err := server.Decrypt(skewedPackets[0]); err == nil {
+		t.Fatal("被淘汰的 nonce 重放后应被拒绝")
+	}
+
+	// 淘汰记录随保留期一起过期
+	now = now.Add(5 * time.Minute)
+	server.cleanup()
+	server.recvNonceCache.mu.Lock()
+	n := len(server.recvNonceCache.evictedSecs)
+	server.recvNonceCache.mu.Unlock()
+	if n != 0 {
+		t.Errorf("过期的淘汰记录未清理: %d", n)
+	}
+}
+
+func TestNonceCacheExpire(t *testing.T) {
+	cache := newNonceCache(0)
+	base := time.Unix(1_700_000_000, 0)
+	for i := 0; i < 10; i++ {
+		var key nonceKey
+		key[0] = byte(i)
+		cache.add(key, base.Add(time.Duration(i)*time.Second))
+	}
+
+	// 按写入时间删除最早的 5 个
+	cache.expire(base.Add(5 * time.Second))
+	if n := cache.len(); n != 5 {
+		t.Fatalf("过期清理后应剩 5 个: %d", n)
+	}
+	var key nonceKey
+	key[0] = 9
+	if cache.add(key, base) {
+		t.Error("未过期的 nonce 应仍被识别为已存在")
+	}
+	key[0] = 0
+	if !cache.add(key, base.Add(10*time.Second)) {
+		t.Error("已过期的 nonce 应可以再次写入")
+	}
+}
@@ -0,0 +1,118 @@
+// internal/crypto/nonce_cache.go
+package crypto
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceKey 以定长数组作为 map 键，避免每次查询都把 nonce 转成 string 分配内存
+type nonceKey [NonceSize]byte
+
+// nonceCache 记录 nonce 及其写入时间，可设置条目上限
+// 时间以 UnixNano 存储，避免 sync.Map 存 time.Time 时的装箱分配
+type nonceCache struct {
+	mu      sync.Mutex
+	entries map[nonceKey]int64
+	order   []nonceKey // 按写入顺序排列，order[head:] 与 entries 一一对应
+	head    int
+	max     int   // 条目上限，0 表示不限制
+	evicted int64 // 因超出上限被提前淘汰的条目数
+
+	// evictedSecs 有条目被提前淘汰的秒 (Unix 秒)，随 expire 一起过期
+	// 只记录被淘汰条目所在的秒，个别时钟超前的客户端不会影响其他时间的数据包
+	evictedSecs map[int64]struct{}
+}
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{
+		entries:     make(map[nonceKey]int64),
+		max:         max,
+		evictedSecs: make(map[int64]struct{}),
+	}
+}
+
+// add 记录 nonce，已存在时返回 false 且不更新时间
+// 达到上限时先淘汰最早写入的条目，内存占用与写入速率无关
+func (n *nonceCache) add(key nonceKey, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, exists := n.entries[key]; exists {
+		return false
+	}
+	if n.max > 0 && len(n.entries) >= n.max {
+		oldest := n.order[n.head]
+		n.evictedSecs[unixSec(n.entries[oldest])] = struct{}{}
+		delete(n.entries, oldest)
+		n.head++
+		n.evicted++
+	}
+	n.entries[key] = now.UnixNano()
+	n.order = append(n.order, key)
+	n.compact()
+	return true
+}
+
+// expire 删除时间早于 before 的 nonce
+// 从最早写入的条目开始删到第一个未过期的为止；时间不严格随写入顺序递增时
+// (如接收缓存记录的是发送时间) 个别条目会晚一些删除，不影响正确性
+func (n *nonceCache) expire(before time.Time) {
+	cutoff := before.UnixNano()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.head < len(n.order) {
+		key := n.order[n.head]
+		if n.entries[key] >= cutoff {
+			break
+		}
+		delete(n.entries, key)
+		n.head++
+	}
+	for sec := range n.evictedSecs {
+		if sec < unixSec(cutoff) {
+			delete(n.evictedSecs, sec)
+		}
+	}
+	n.compact()
+}
+
+// compact 已出队的部分超过一半时回收 order 的前部空间
+func (n *nonceCache) compact() {
+	if n.head > 0 && n.head >= len(n.order)/2 {
+		n.order = append(n.order[:0], n.order[n.head:]...)
+		n.head = 0
+	}
+}
+
+// contains 判断 nonce 是否在缓存中
+func (n *nonceCache) contains(key nonceKey) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, exists := n.entries[key]
+	return exists
+}
+
+// evictedAt 判断与 t 同一秒的条目是否被提前淘汰过，此时缓存已无法确认这一秒的 nonce 是否出现过
+func (n *nonceCache) evictedAt(t time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, evicted := n.evictedSecs[t.Unix()]
+	return evicted
+}
+
+func (n *nonceCache) len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.entries)
+}
+
+// unixSec 把 UnixNano 换算为所在的 Unix 秒 (向下取整)
+func unixSec(nano int64) int64 {
+	return time.Unix(0, nano).Unix()
+}
+
+func (n *nonceCache) evictions() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.evicted
+}
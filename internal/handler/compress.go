@@ -0,0 +1,56 @@
+// internal/handler/compress.go
+
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxDecompressedSize 单帧解压后的上限，防止压缩炸弹
+const maxDecompressedSize = 1 << 20
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressPayload 压缩负载，只有压缩后更小时才返回 true，
+// 不可压缩的数据原样发送，避免膨胀
+func compressPayload(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil {
+		return data, false
+	}
+	if buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressPayload 解压负载
+func decompressPayload(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("解压失败: %w", err)
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("解压后数据过大")
+	}
+	return out, nil
+}
@@ -0,0 +1,62 @@
+// internal/handler/decoy.go
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// 探测诱饵模式
+const (
+	DecoyNone = ""     // 不做处理，静默丢弃无效数据 (默认)
+	DecoyHTTP = "http" // 伪装成普通 Web 服务器，返回 400 后关闭
+	DecoyHold = "hold" // 吞掉输入并保持连接一段随机时间后关闭
+)
+
+const (
+	// probeDecoyThreshold 首个合法帧之前允许的解密失败次数，达到后触发诱饵
+	probeDecoyThreshold = 3
+	// probeFirstFrameTimeout 开启诱饵时等待首个帧的超时
+	// 扫描器通常只发一小段数据就等待响应，不能按正常的读超时等 5 分钟
+	probeFirstFrameTimeout = 10 * time.Second
+	// defaultDecoyHoldMax hold 模式保持连接的最长时间
+	defaultDecoyHoldMax = 60 * time.Second
+)
+
+const decoyHTTPBody = "<html>\r\n<head><title>400 Bad Request</title></head>\r\n" +
+	"<body>\r\n<center><h1>400 Bad Request</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+
+var decoyHTTPResponse = fmt.Sprintf("HTTP/1.1 400 Bad Request\r\n"+
+	"Server: nginx\r\n"+
+	"Content-Type: text/html\r\n"+
+	"Content-Length: %d\r\n"+
+	"Connection: close\r\n\r\n%s", len(decoyHTTPBody), decoyHTTPBody)
+
+// ValidateDecoyMode 校验诱饵模式名称
+func ValidateDecoyMode(mode string) error {
+	switch mode {
+	case DecoyNone, DecoyHTTP, DecoyHold:
+		return nil
+	default:
+		return fmt.Errorf("未知的诱饵模式: %q", mode)
+	}
+}
+
+// decoy 对疑似主动探测的连接执行诱饵行为，返回后调用方关闭连接
+func (h *TCPHandler) decoy(conn net.Conn) {
+	h.logDebug("疑似探测，执行诱饵 (%s): %s", h.probeDecoy, conn.RemoteAddr())
+
+	switch h.probeDecoy {
+	case DecoyHTTP:
+		_ = conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		_, _ = io.WriteString(conn, decoyHTTPResponse)
+	case DecoyHold:
+		hold := time.Duration(rand.Int63n(int64(h.decoyHoldMax)/2)) + h.decoyHoldMax/2
+		_ = conn.SetReadDeadline(time.Now().Add(hold))
+		_, _ = io.Copy(io.Discard, conn)
+	}
+}
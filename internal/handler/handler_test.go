@@ -2,12 +2,31 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/anthropics/phantom-server/internal/crypto"
+	"github.com/anthropics/phantom-server/internal/protocol"
+	"github.com/anthropics/phantom-server/internal/transport"
 )
 
 func TestTCPHandlerBasic(t *testing.T) {
@@ -27,6 +46,33 @@ func TestTCPHandlerBasic(t *testing.T) {
 	}
 }
 
+func TestTCPHandlerCloseStopsCleanup(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		h := NewTCPHandler(cry, "error", WithCleanupInterval(time.Millisecond))
+		h.Close()
+		h.Close() // 可重复调用
+	}
+
+	// 等待 cleanupLoop 退出
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Close 后 goroutine 泄漏: %d -> %d", before, after)
+	}
+}
+
 func TestTCPHandlerDecryptFail(t *testing.T) {
 	psk, err := crypto.GeneratePSK()
 	if err != nil {
@@ -119,6 +165,7 @@ type mockConn struct {
 	readData  []byte
 	writeData []byte
 	closed    bool
+	mu        sync.Mutex // 保护 writeData，关闭通知在独立的 goroutine 中写入
 }
 
 func (m *mockConn) Read(b []byte) (n int, err error) {
@@ -131,10 +178,26 @@ func (m *mockConn) Read(b []byte) (n int, err error) {
 }
 
 func (m *mockConn) Write(b []byte) (n int, err error) {
+	m.mu.Lock()
 	m.writeData = append(m.writeData, b...)
+	m.mu.Unlock()
 	return len(b), nil
 }
 
+// written 等待写入数据并返回其副本，超时未写入时返回 nil
+func (m *mockConn) written(timeout time.Duration) []byte {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		data := append([]byte(nil), m.writeData...)
+		m.mu.Unlock()
+		if len(data) > 0 || time.Now().After(deadline) {
+			return data
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
 func (m *mockConn) Close() error {
 	m.closed = true
 	return nil
@@ -168,3 +231,2233 @@ func TestHandlerWithMockConn(t *testing.T) {
 	// 这会因为没有数据而快速退出
 	h.HandleConnection(ctx, mock)
 }
+
+func TestMaxConnLifetime(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithMaxConnLifetime(time.Minute))
+
+	// 连接仍然活跃，但已经建立了 2 分钟
+	target := &mockConn{}
+	client := &mockConn{}
+	c := &Conn{
+		ID:         42,
+		Target:     target,
+		ClientConn: client,
+		Writer:     transport.NewFrameWriter(client, time.Second),
+		CreatedAt:  time.Now().Add(-2 * time.Minute),
+		LastActive: time.Now(),
+	}
+	h.conns.Store(uint32(42), c)
+
+	h.cleanup()
+
+	if _, ok := h.conns.Load(uint32(42)); ok {
+		t.Fatal("超过最长存活时间的连接应该被关闭")
+	}
+	if !target.closed {
+		t.Error("目标连接应该被关闭")
+	}
+
+	// 客户端应收到加密的断开通知
+	reader := transport.NewFrameReader(&mockConn{readData: client.written(time.Second)}, 0)
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("读取断开通知失败: %v", err)
+	}
+	msg, err := cry.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("解密断开通知失败: %v", err)
+	}
+	if msg[0] != protocol.TypeDisconnect || binary.BigEndian.Uint32(msg[1:5]) != 42 {
+		t.Errorf("断开通知内容错误: %v", msg)
+	}
+
+	// 新建立的连接不受影响
+	fresh := &Conn{
+		ID:         43,
+		Target:     &mockConn{},
+		CreatedAt:  time.Now(),
+		LastActive: time.Now(),
+	}
+	h.conns.Store(uint32(43), fresh)
+	h.cleanup()
+	if _, ok := h.conns.Load(uint32(43)); !ok {
+		t.Error("未超时的连接不应被关闭")
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithCleanupInterval(50*time.Millisecond))
+
+	c := &Conn{
+		ID:         1,
+		Target:     &mockConn{},
+		LastActive: time.Now().Add(-10 * time.Minute),
+	}
+	h.conns.Store(uint32(1), c)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := h.conns.Load(uint32(1)); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("超时连接未被及时清理")
+}
+
+// buildConnect 构造一条 TCP Connect 消息
+func buildConnect(reqID uint32, addr *net.TCPAddr) []byte {
+	msg, _ := protocol.BuildConnect(reqID, protocol.NetworkTCP, addr.IP.String(), uint16(addr.Port), nil)
+	return msg
+}
+
+// listenTarget 启动一个接受连接但不做处理的本地目标
+func listenTarget(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestMaxConnsBusy(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithMaxConns(1))
+	defer h.Close()
+	addr := listenTarget(t)
+
+	client := &mockConn{}
+	writer := transport.NewFrameWriter(client, time.Second)
+
+	resp, err := cry.Decrypt(h.handleConnect(buildConnect(1, addr), client, writer))
+	if err != nil {
+		t.Fatalf("解密响应失败: %v", err)
+	}
+	if resp[5] != protocol.StatusOK {
+		t.Fatalf("第一个连接应该成功: status=%d", resp[5])
+	}
+
+	resp, err = cry.Decrypt(h.handleConnect(buildConnect(2, addr), client, writer))
+	if err != nil {
+		t.Fatalf("解密响应失败: %v", err)
+	}
+	if resp[5] != protocol.StatusBusy {
+		t.Fatalf("超出上限应返回 StatusBusy: status=%d", resp[5])
+	}
+	if len(resp) != 8 || time.Duration(binary.BigEndian.Uint16(resp[6:8]))*time.Second != BusyRetryAfter {
+		t.Errorf("StatusBusy 应携带建议等待时间: %v", resp)
+	}
+
+	// 释放名额后可以再次连接
+	h.CloseConn(1)
+	resp, err = cry.Decrypt(h.handleConnect(buildConnect(3, addr), client, writer))
+	if err != nil {
+		t.Fatalf("解密响应失败: %v", err)
+	}
+	if resp[5] != protocol.StatusOK {
+		t.Errorf("释放名额后应该可以连接: status=%d", resp[5])
+	}
+}
+
+// lockedBuffer 并发安全的日志缓冲
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog 将标准 logger 的输出重定向到缓冲，测试结束后恢复
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+	buf := &lockedBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestAccessLog(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 目标读取 4 字节请求后回复 11 字节并关闭
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("hello world"))
+	}()
+
+	logs := captureLog(t)
+	h := NewTCPHandler(cry, "info", WithAccessLog(true))
+	defer h.Close()
+
+	client := &mockConn{}
+	msg := append(buildConnect(9, ln.Addr().(*net.TCPAddr)), []byte("ping")...)
+	if resp := h.handleConnect(msg, client, transport.NewFrameWriter(client, time.Second)); resp == nil {
+		t.Fatal("Connect 没有响应")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !strings.Contains(logs.String(), "[ACCESS]") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "[ACCESS]") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 1 {
+		t.Fatalf("应该恰好输出一行访问日志，实际 %d 行:\n%s", len(lines), logs.String())
+	}
+	for _, want := range []string{"id=9", "network=tcp", "up=4", "down=11", "reason=target_close"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("访问日志缺少 %q: %s", want, lines[0])
+		}
+	}
+}
+
+// buildConnectDomain 构造一条域名 TCP Connect 消息
+func buildConnectDomain(reqID uint32, domain string, port uint16) []byte {
+	msg, _ := protocol.BuildConnect(reqID, protocol.NetworkTCP, domain, port, nil)
+	return msg
+}
+
+// timeoutError 模拟黑洞地址的拨号超时
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialErrorStatus(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithDialTimeout(2*time.Second))
+	defer h.Close()
+
+	// 取一个已释放的端口，连接会被拒绝
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	refused := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	connect := func(msg []byte) byte {
+		t.Helper()
+		client := &mockConn{}
+		resp, err := cry.Decrypt(h.handleConnect(msg, client, transport.NewFrameWriter(client, time.Second)))
+		if err != nil {
+			t.Fatalf("解密响应失败: %v", err)
+		}
+		return resp[5]
+	}
+
+	if status := connect(buildConnectDomain(1, "phantom-test.invalid", 80)); status != protocol.StatusDNSFailed {
+		t.Errorf("域名解析失败应返回 StatusDNSFailed: %d", status)
+	}
+	if status := connect(buildConnect(2, refused)); status != protocol.StatusConnRefused {
+		t.Errorf("拒绝连接应返回 StatusConnRefused: %d", status)
+	}
+
+	// 黑洞地址在沙箱中表现不稳定，直接检查错误映射
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	if status := dialStatus(timeout); status != protocol.StatusTimeout {
+		t.Errorf("超时应返回 StatusTimeout: %d", status)
+	}
+	if status := dialStatus(errors.New("other")); status != protocol.StatusConnectFailed {
+		t.Errorf("其他错误应返回 StatusConnectFailed: %d", status)
+	}
+}
+
+func TestCompressPayload(t *testing.T) {
+	compressible := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n"), 100)
+
+	compressed, ok := compressPayload(compressible)
+	if !ok {
+		t.Fatal("可压缩数据应该被压缩")
+	}
+	if len(compressed) >= len(compressible) {
+		t.Errorf("压缩后未变小: %d >= %d", len(compressed), len(compressible))
+	}
+	out, err := decompressPayload(compressed)
+	if err != nil {
+		t.Fatalf("解压失败: %v", err)
+	}
+	if !bytes.Equal(out, compressible) {
+		t.Error("解压结果不匹配")
+	}
+
+	// 随机数据不可压缩，应原样返回
+	incompressible := make([]byte, 4096)
+	if _, err := rand.Read(incompressible); err != nil {
+		t.Fatalf("生成随机数据失败: %v", err)
+	}
+	same, ok := compressPayload(incompressible)
+	if ok {
+		t.Error("不可压缩数据不应被标记为压缩")
+	}
+	if !bytes.Equal(same, incompressible) {
+		t.Error("不可压缩数据应原样返回")
+	}
+
+	if _, err := decompressPayload([]byte{0xFF, 0xFF, 0xFF}); err == nil {
+		t.Error("损坏的压缩数据应该解压失败")
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithAllowedNetworks(protocol.NetworkTCP))
+	defer h.Close()
+	addr := listenTarget(t)
+
+	connect := func(msg []byte) byte {
+		t.Helper()
+		client := &mockConn{}
+		resp, err := cry.Decrypt(h.handleConnect(msg, client, transport.NewFrameWriter(client, time.Second)))
+		if err != nil {
+			t.Fatalf("解密响应失败: %v", err)
+		}
+		return resp[5]
+	}
+
+	udp := buildConnect(1, addr)
+	udp[5] = protocol.NetworkUDP
+	if status := connect(udp); status != protocol.StatusNotAllowed {
+		t.Errorf("UDP Connect 应被拒绝: status=%d", status)
+	}
+	if status := connect(buildConnect(2, addr)); status != protocol.StatusOK {
+		t.Errorf("TCP Connect 应该成功: status=%d", status)
+	}
+}
+
+// stallConn 模拟停止读取的客户端：写入一直阻塞到写超时
+type stallConn struct {
+	mockConn
+	mu       sync.Mutex
+	deadline time.Time
+	closedCh chan struct{}
+}
+
+func (s *stallConn) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.deadline = t
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *stallConn) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+	select {
+	case <-time.After(time.Until(deadline)):
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: timeoutError{}}
+	case <-s.closedCh:
+		return 0, net.ErrClosed
+	}
+}
+
+func (s *stallConn) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closedCh:
+	default:
+		close(s.closedCh)
+	}
+	return nil
+}
+
+func TestWriteTimeoutClosesClient(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 目标连接建立后立即发送数据
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("data for a stalled client"))
+		time.Sleep(2 * time.Second)
+	}()
+
+	h := NewTCPHandler(cry, "error", WithWriteTimeout(50*time.Millisecond))
+	defer h.Close()
+
+	client := &stallConn{closedCh: make(chan struct{})}
+	resp := h.handleConnect(buildConnect(1, ln.Addr().(*net.TCPAddr)), client, transport.NewFrameWriter(client, h.writeTimeout))
+	if resp == nil {
+		t.Fatal("Connect 没有响应")
+	}
+
+	select {
+	case <-client.closedCh:
+	case <-time.After(time.Second):
+		t.Fatal("写超时后客户端连接应该被关闭")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := h.conns.Load(uint32(1)); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("写超时后代理连接应该被移除")
+}
+
+func TestStopGracefulNotifiesClients(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer conn.Close()
+
+	// 等待服务端登记该客户端
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		registered := false
+		h.clients.Range(func(_, _ interface{}) bool {
+			registered = true
+			return false
+		})
+		if registered {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.StopGraceful(2 * time.Second)
+		close(done)
+	}()
+
+	frame, err := transport.NewFrameReader(conn, time.Second).ReadFrame()
+	if err != nil {
+		t.Fatalf("读取关闭通知失败: %v", err)
+	}
+	msg, err := cry.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("解密关闭通知失败: %v", err)
+	}
+	if msg[0] != protocol.TypeServerShutdown {
+		t.Errorf("应收到 TypeServerShutdown: 0x%02x", msg[0])
+	}
+
+	// 客户端收到通知后主动断开，服务端应在超时前完成停止
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("客户端断开后 StopGraceful 应尽快返回")
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	logs := captureLog(t)
+	h := NewTCPHandler(cry, "info")
+
+	h.logDebug("before")
+	if strings.Contains(logs.String(), "before") {
+		t.Fatal("info 级别不应输出 debug 日志")
+	}
+
+	h.SetLogLevel("debug")
+	h.logDebug("after")
+	if !strings.Contains(logs.String(), "[DEBUG] after") {
+		t.Errorf("切换到 debug 后应输出 debug 日志: %q", logs.String())
+	}
+}
+
+// testClient 通过真实 socket 与服务端通信的最小客户端
+type testClient struct {
+	conn   net.Conn
+	cry    *crypto.Crypto
+	reader *transport.FrameReader
+	writer *transport.FrameWriter
+}
+
+func dialTestClient(t *testing.T, addr string, psk string) *testClient {
+	t.Helper()
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建客户端 Crypto 失败: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("连接服务端失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{
+		conn:   conn,
+		cry:    cry,
+		reader: transport.NewFrameReader(conn, 2*time.Second),
+		writer: transport.NewFrameWriter(conn, 2*time.Second),
+	}
+}
+
+func (c *testClient) send(t *testing.T, msg []byte) {
+	t.Helper()
+	encrypted, err := c.cry.Encrypt(msg)
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	if err := c.writer.WriteFrame(encrypted); err != nil {
+		t.Fatalf("发送失败: %v", err)
+	}
+}
+
+func (c *testClient) recv(t *testing.T) []byte {
+	t.Helper()
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	msg, err := c.cry.Decrypt(frame)
+	if err != nil {
+		t.Fatalf("解密失败: %v", err)
+	}
+	return msg
+}
+
+// recvData 读取数据消息直到累计 n 字节
+func (c *testClient) recvData(t *testing.T, reqID uint32, n int) []byte {
+	t.Helper()
+	var got []byte
+	for len(got) < n {
+		msg := c.recv(t)
+		if msg[0] != protocol.TypeData {
+			t.Fatalf("应收到 TypeData: 0x%02x", msg[0])
+		}
+		if id := binary.BigEndian.Uint32(msg[1:5]); id != reqID {
+			t.Fatalf("ReqID 错误: %d", id)
+		}
+		got = append(got, msg[5:]...)
+	}
+	return got
+}
+
+func TestEndToEnd(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 回显目标
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	target := echo.Addr().(*net.TCPAddr)
+
+	// 建立连接，附带首包数据
+	const reqID = 42
+	connect, err := protocol.BuildConnect(reqID, protocol.NetworkTCP, target.IP.String(), uint16(target.Port), []byte("hello "))
+	if err != nil {
+		t.Fatalf("构造 Connect 失败: %v", err)
+	}
+	client.send(t, connect)
+
+	id, status, _, err := protocol.ParseResponse(client.recv(t))
+	if err != nil {
+		t.Fatalf("解析连接响应失败: %v", err)
+	}
+	if id != reqID || status != protocol.StatusOK {
+		t.Fatalf("连接响应错误: id=%d status=0x%02x", id, status)
+	}
+
+	client.send(t, protocol.BuildData(reqID, []byte("world")))
+	if got := client.recvData(t, reqID, 11); string(got) != "hello world" {
+		t.Errorf("回显数据错误: %q", got)
+	}
+
+	// 较大的负载分块发送，验证双向数据完整
+	// 逐块收发，避免双方缓冲区写满
+	const chunk = 16 * 1024
+	payload := make([]byte, 16*chunk)
+	rand.Read(payload)
+	var echoed []byte
+	for off := 0; off < len(payload); off += chunk {
+		client.send(t, protocol.BuildData(reqID, payload[off:off+chunk]))
+		echoed = append(echoed, client.recvData(t, reqID, chunk)...)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Error("大块回显数据不一致")
+	}
+
+	stats := h.Stats()
+	if stats.BytesToTarget != int64(len(payload))+11 || stats.BytesFromTarget != int64(len(payload))+11 {
+		t.Errorf("流量统计错误: %+v", stats)
+	}
+
+	// 关闭后服务端应释放代理连接
+	client.send(t, protocol.BuildClose(reqID))
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(h.Conns()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(h.Conns()); n != 0 {
+		t.Fatalf("关闭后仍有 %d 个代理连接", n)
+	}
+
+	client.conn.Close()
+	deadline = time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && srv.Stats().ActiveConns > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := srv.Stats().ActiveConns; n != 0 {
+		t.Errorf("客户端断开后仍有 %d 个活跃连接", n)
+	}
+}
+
+// TestConnectInitialData 首包数据随 Connect 一起到达目标，目标先收到这些字节，无需额外的往返
+func TestConnectInitialData(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 目标先读完客户端的首包再应答，类似 TLS 服务端等待 ClientHello
+	initData := []byte("client hello")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer target.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, len(initData))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		received <- buf
+		c.Write([]byte("server hello"))
+		io.Copy(io.Discard, c)
+	}()
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	addr := target.Addr().(*net.TCPAddr)
+	const reqID = 7
+	connect, err := protocol.BuildConnect(reqID, protocol.NetworkTCP, addr.IP.String(), uint16(addr.Port), initData)
+	if err != nil {
+		t.Fatalf("构造 Connect 失败: %v", err)
+	}
+	client.send(t, connect)
+
+	if _, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || status != protocol.StatusOK {
+		t.Fatalf("连接响应错误: status=0x%02x err=%v", status, err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, initData) {
+			t.Errorf("目标首先收到的数据错误: %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("目标未收到首包数据")
+	}
+
+	// 客户端没有发送任何 Data，目标的应答已经返回
+	if got := client.recvData(t, reqID, len("server hello")); string(got) != "server hello" {
+		t.Errorf("目标应答错误: %q", got)
+	}
+	if stats := h.Stats(); stats.BytesToTarget != int64(len(initData)) {
+		t.Errorf("首包数据未计入流量统计: %+v", stats)
+	}
+}
+
+func TestConnectMalformedStatus(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+	writer := transport.NewFrameWriter(client, time.Second)
+
+	// 合法消息的每一种截断，以及解析器拒绝的随机消息，都应得到 StatusError
+	var inputs [][]byte
+	valid := buildConnectDomain(7, "example.com", 443)
+	for n := 5; n < len(valid); n++ {
+		inputs = append(inputs, valid[:n])
+	}
+	rng := mathrand.New(mathrand.NewSource(1))
+	for len(inputs) < 2000 {
+		data := make([]byte, 5+rng.Intn(40))
+		rng.Read(data)
+		data[0] = protocol.TypeConnect
+		if _, err := protocol.ParseRequest(data); err != nil {
+			inputs = append(inputs, data)
+		}
+	}
+
+	for _, data := range inputs {
+		resp, err := cry.Decrypt(h.handleConnect(data, client, writer))
+		if err != nil {
+			t.Fatalf("解密响应失败: %x: %v", data, err)
+		}
+		reqID, status, _, err := protocol.ParseResponse(resp)
+		if err != nil {
+			t.Fatalf("解析响应失败: %v", err)
+		}
+		if reqID != binary.BigEndian.Uint32(data[1:5]) || status != protocol.StatusError {
+			t.Fatalf("畸形消息 %x 应回复 StatusError: id=%d status=0x%02x", data, reqID, status)
+		}
+	}
+	if n := len(h.Conns()); n != 0 {
+		t.Errorf("畸形消息不应建立连接: %d", n)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 持续输出数据的目标，模拟大流量下载
+	flood, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer flood.Close()
+	go func() {
+		c, err := flood.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		chunk := make([]byte, 32*1024)
+		for {
+			if _, err := c.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	const window = 4096
+	h := NewTCPHandler(cry, "error", WithFlowControl(window))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	client.send(t, buildConnect(1, flood.Addr().(*net.TCPAddr)))
+	client.send(t, buildConnect(2, echo.Addr().(*net.TCPAddr)))
+	client.send(t, protocol.BuildData(2, []byte("ping")))
+
+	// 连接 1 的客户端不追加额度，连接 2 的回显仍应到达
+	floodBytes := 0
+	var echoed []byte
+	for len(echoed) < 4 {
+		msg := client.recv(t)
+		if msg[0] != protocol.TypeData {
+			continue
+		}
+		switch binary.BigEndian.Uint32(msg[1:5]) {
+		case 1:
+			floodBytes += len(msg) - 5
+		case 2:
+			echoed = append(echoed, msg[5:]...)
+		}
+	}
+	if string(echoed) != "ping" {
+		t.Errorf("回显数据错误: %q", echoed)
+	}
+	if floodBytes > window {
+		t.Fatalf("发送量超出流控额度: %d > %d", floodBytes, window)
+	}
+
+	// 收齐初始额度后追加额度，连接 1 应继续传输
+	for floodBytes < window {
+		msg := client.recv(t)
+		if msg[0] == protocol.TypeData && binary.BigEndian.Uint32(msg[1:5]) == 1 {
+			floodBytes += len(msg) - 5
+		}
+	}
+	client.send(t, protocol.BuildWindowUpdate(1, window))
+	for floodBytes < 2*window {
+		msg := client.recv(t)
+		if msg[0] == protocol.TypeData && binary.BigEndian.Uint32(msg[1:5]) == 1 {
+			floodBytes += len(msg) - 5
+		}
+	}
+	if floodBytes != 2*window {
+		t.Errorf("追加额度后的发送量错误: %d", floodBytes)
+	}
+}
+
+func TestProbeDecoy(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithProbeDecoy(DecoyHTTP))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	// 连续发送无法解密的帧，应收到伪装的 HTTP 400
+	probe, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer probe.Close()
+	writer := transport.NewFrameWriter(probe, time.Second)
+	junk := make([]byte, 64)
+	for i := 0; i < probeDecoyThreshold; i++ {
+		rand.Read(junk)
+		if err := writer.WriteFrame(junk); err != nil {
+			t.Fatalf("发送失败: %v", err)
+		}
+	}
+	probe.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(probe)
+	if err != nil {
+		t.Fatalf("读取诱饵响应失败: %v", err)
+	}
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 400 Bad Request\r\n") {
+		t.Errorf("应收到 HTTP 400: %q", resp)
+	}
+
+	// 合法客户端不受影响
+	target := listenTarget(t)
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	client.send(t, buildConnect(1, target))
+	_, status, _, err := protocol.ParseResponse(client.recv(t))
+	if err != nil || status != protocol.StatusOK {
+		t.Fatalf("合法客户端连接失败: status=0x%02x err=%v", status, err)
+	}
+
+	// 认证之后的无效帧仍然静默丢弃
+	for i := 0; i < probeDecoyThreshold; i++ {
+		rand.Read(junk)
+		if err := client.writer.WriteFrame(junk); err != nil {
+			t.Fatalf("发送失败: %v", err)
+		}
+	}
+	client.send(t, protocol.BuildClose(1))
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(h.Conns()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(h.Conns()); n != 0 {
+		t.Errorf("认证后的连接应继续正常处理: 剩余 %d 个连接", n)
+	}
+}
+
+func TestProbeDecoyHold(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithProbeDecoy(DecoyHold))
+	defer h.Close()
+	h.decoyHoldMax = 200 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		h.HandleConnection(context.Background(), server)
+		server.Close()
+		close(done)
+	}()
+
+	// 长度为 0 的帧格式错误，触发诱饵
+	client.Write([]byte{0, 0})
+	go io.Copy(io.Discard, client)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("hold 诱饵应在最长保持时间后返回")
+	}
+	if elapsed := time.Since(start); elapsed < h.decoyHoldMax/2 {
+		t.Errorf("hold 诱饵保持时间过短: %v", elapsed)
+	}
+}
+
+func TestSelfAddrLoop(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	self := listenTarget(t)
+	other := listenTarget(t)
+	port := strconv.Itoa(self.Port)
+
+	for _, selfAddr := range []string{self.String(), ":" + port, "0.0.0.0:" + port} {
+		h := NewTCPHandler(cry, "error", WithSelfAddrs(selfAddr))
+		client, peer := net.Pipe()
+		writer := transport.NewFrameWriter(client, time.Second)
+
+		tests := []struct {
+			msg    []byte
+			status byte
+		}{
+			{buildConnect(1, self), protocol.StatusLoopDetected},
+			{buildConnect(2, other), protocol.StatusOK},
+		}
+		if selfAddr != self.String() {
+			// 监听全部地址时，解析到任一本机地址的域名也应被拦截
+			tests = append(tests, struct {
+				msg    []byte
+				status byte
+			}{buildConnectDomain(3, "localhost", uint16(self.Port)), protocol.StatusLoopDetected})
+		}
+		for _, tt := range tests {
+			resp, err := cry.Decrypt(h.handleConnect(tt.msg, client, writer))
+			if err != nil {
+				t.Fatalf("解密响应失败: %v", err)
+			}
+			if resp[5] != tt.status {
+				t.Errorf("自身地址 %s: 期望状态 0x%02x，实际 0x%02x", selfAddr, tt.status, resp[5])
+			}
+		}
+		h.Close()
+		client.Close()
+		peer.Close()
+	}
+
+	if err := ValidateSelfAddrs([]string{"example.com:80"}); err == nil {
+		t.Error("域名形式的自身地址应该被拒绝")
+	}
+}
+
+func TestHandleConnectionContextCancel(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.HandleConnection(ctx, server)
+		close(done)
+	}()
+
+	// 等待进入阻塞读取后取消
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ctx 取消后 HandleConnection 应立即返回")
+	}
+}
+
+func TestFrameTimeoutClosesConn(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithFrameTimeout(100*time.Millisecond))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer conn.Close()
+
+	// 发出合法的长度前缀后停止发送
+	if _, err := conn.Write([]byte{0, 100, 1, 2, 3}); err != nil {
+		t.Fatalf("发送失败: %v", err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("服务端应关闭连接: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("应在帧体超时后关闭连接: %v", elapsed)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithMemoryBudget(clientMemCost+2*connMemCost))
+	defer h.Close()
+	addr := listenTarget(t)
+
+	// 预算只够一个客户端连接
+	client, server := net.Pipe()
+	defer client.Close()
+	go h.HandleConnection(context.Background(), server)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && h.Stats().MemoryReserved < clientMemCost {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, secondServer := net.Pipe()
+	defer second.Close()
+	done := make(chan struct{})
+	go func() {
+		h.HandleConnection(context.Background(), secondServer)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("超出内存预算的客户端连接应被立即拒绝")
+	}
+
+	// 剩余预算只够两个代理连接
+	writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+	status := func(reqID uint32) byte {
+		resp, err := cry.Decrypt(h.handleConnect(buildConnect(reqID, addr), &mockConn{}, writer))
+		if err != nil {
+			t.Fatalf("解密响应失败: %v", err)
+		}
+		return resp[5]
+	}
+	if s1, s2 := status(1), status(2); s1 != protocol.StatusOK || s2 != protocol.StatusOK {
+		t.Fatalf("预算内的连接应该成功: %d %d", s1, s2)
+	}
+	if s := status(3); s != protocol.StatusBusy {
+		t.Fatalf("超出内存预算应返回 StatusBusy: %d", s)
+	}
+	if used := h.Stats().MemoryReserved; used != clientMemCost+2*connMemCost {
+		t.Errorf("内存占用统计错误: %d", used)
+	}
+
+	// 连接关闭后恢复
+	h.CloseConn(1)
+	if s := status(4); s != protocol.StatusOK {
+		t.Errorf("释放预算后应该可以连接: %d", s)
+	}
+}
+
+func TestTrafficHint(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error")
+	defer h.Close()
+
+	// 直接驱动 HandleConnection，便于读取服务端一侧连接的 TCP_NODELAY
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer ln.Close()
+	client := dialTestClient(t, ln.Addr().String(), psk)
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("接受连接失败: %v", err)
+	}
+	defer conn.Close()
+	serverConn := conn.(*net.TCPConn)
+	go h.HandleConnection(context.Background(), serverConn)
+
+	noDelay := func() bool {
+		raw, err := serverConn.SyscallConn()
+		if err != nil {
+			t.Fatalf("获取 socket 失败: %v", err)
+		}
+		var v int
+		raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		})
+		if err != nil {
+			t.Fatalf("读取 TCP_NODELAY 失败: %v", err)
+		}
+		return v != 0
+	}
+	waitNoDelay := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) && noDelay() != want {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := noDelay(); got != want {
+			t.Fatalf("TCP_NODELAY 应为 %v，实际 %v", want, got)
+		}
+	}
+
+	waitNoDelay(true)
+	client.send(t, protocol.BuildTrafficHint(protocol.TrafficBulk))
+	waitNoDelay(false)
+	client.send(t, protocol.BuildTrafficHint(protocol.TrafficInteractive))
+	waitNoDelay(true)
+}
+
+// mockConnectProxy 最小的 HTTP CONNECT 代理，要求 Basic 认证，拒绝 blocked 目标
+func mockConnectProxy(t *testing.T, user, pass string, blocked string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听代理失败: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if u, p, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); !ok || u != user || p != pass {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				if req.Host == blocked {
+					io.WriteString(c, "HTTP/1.1 403 Forbidden\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, br)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func parseProxyAuth(header string) (user, pass string, ok bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	blocked := listenTarget(t)
+	proxyAddr := mockConnectProxy(t, "user", "secret", blocked.String())
+
+	up, err := ParseUpstream("http://user:secret@" + proxyAddr)
+	if err != nil {
+		t.Fatalf("解析上游代理失败: %v", err)
+	}
+	h := NewTCPHandler(cry, "error", WithUpstream(up))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	// 经上游代理到达目标，并携带首包数据
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	target := echo.Addr().(*net.TCPAddr)
+	connect, _ := protocol.BuildConnect(1, protocol.NetworkTCP, target.IP.String(), uint16(target.Port), []byte("hello"))
+	client.send(t, connect)
+	if _, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || status != protocol.StatusOK {
+		t.Fatalf("经上游代理连接失败: status=0x%02x err=%v", status, err)
+	}
+	if got := client.recvData(t, 1, 5); string(got) != "hello" {
+		t.Errorf("回显数据错误: %q", got)
+	}
+
+	// 上游拒绝映射为对应状态码
+	writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+	resp, err := cry.Decrypt(h.handleConnect(buildConnect(2, blocked), &mockConn{}, writer))
+	if err != nil || resp[5] != protocol.StatusNotAllowed {
+		t.Errorf("上游返回 403 应映射为 StatusNotAllowed: %v %v", resp, err)
+	}
+
+	bad, _ := ParseUpstream("http://user:wrong@" + proxyAddr)
+	h2 := NewTCPHandler(cry, "error", WithUpstream(bad))
+	defer h2.Close()
+	resp, err = cry.Decrypt(h2.handleConnect(buildConnect(3, target), &mockConn{}, writer))
+	if err != nil || resp[5] != protocol.StatusConnectFailed {
+		t.Errorf("上游认证失败应返回 StatusConnectFailed: %v %v", resp, err)
+	}
+
+	for _, raw := range []string{"socks5://127.0.0.1:1080", "http://127.0.0.1", "://bad"} {
+		if _, err := ParseUpstream(raw); err == nil {
+			t.Errorf("无效的上游地址 %q 应该被拒绝", raw)
+		}
+	}
+}
+
+// failReader 总是返回错误的随机源，用于制造加密失败
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) { return 0, errors.New("随机源不可用") }
+
+func TestCryptoFailFast(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	// 服务端加密必然失败，解密不受影响
+	broken, err := crypto.New(psk, 30, crypto.WithRand(failReader{}))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	target := listenTarget(t)
+
+	for _, failFast := range []bool{false, true} {
+		h := NewTCPHandler(broken, "error", WithCryptoFailFast(failFast))
+		srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("启动失败: %v", err)
+		}
+
+		client := dialTestClient(t, srv.Addr().String(), psk)
+		for i := 0; i < CryptoFailFastThreshold; i++ {
+			msg, _ := protocol.BuildConnect(uint32(i+1), protocol.NetworkTCP, "127.0.0.1", uint16(target.Port), nil)
+			client.send(t, msg)
+		}
+
+		client.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, err := client.conn.Read(make([]byte, 1))
+		var netErr net.Error
+		timedOut := errors.As(err, &netErr) && netErr.Timeout()
+		if failFast && err != io.EOF {
+			t.Errorf("fail-fast 下连续加密失败应关闭连接: %v", err)
+		}
+		if !failFast && !timedOut {
+			t.Errorf("默认策略下加密失败只丢弃消息，连接应保持: %v", err)
+		}
+		if n := h.Stats().EncryptFailed; n < CryptoFailFastThreshold {
+			t.Errorf("加密失败计数错误: %d", n)
+		}
+
+		// 关闭通知同样按加密失败统计
+		before := h.Stats().EncryptFailed
+		h.NotifyShutdown()
+		if n := h.Stats().EncryptFailed; !failFast && n != before+1 {
+			t.Errorf("关闭通知加密失败未计数: %d -> %d", before, n)
+		}
+
+		h.Close()
+		srv.Stop()
+	}
+}
+
+// switchReader 可切换的随机源，fail 为 true 时读取失败
+type switchReader struct{ fail atomic.Bool }
+
+func (r *switchReader) Read(b []byte) (int, error) {
+	if r.fail.Load() {
+		return 0, errors.New("随机源不可用")
+	}
+	return rand.Read(b)
+}
+
+// TestCryptoFailFastPerClient 连续失败按客户端分别计数，只关闭自身失败达到阈值的客户端
+func TestCryptoFailFastPerClient(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	random := &switchReader{}
+	cry, err := crypto.New(psk, 30, crypto.WithRand(random))
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+	target := listenTarget(t)
+
+	h := NewTCPHandler(cry, "error", WithCryptoFailFast(true))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	failing := dialTestClient(t, srv.Addr().String(), psk)
+	healthy := dialTestClient(t, srv.Addr().String(), psk)
+	reqID := uint32(0)
+	// connect 发送一个 Connect，等服务端处理完 (加密响应成功或失败) 后返回
+	connect := func(c *testClient) {
+		t.Helper()
+		reqID++
+		before := h.Stats().EncryptFailed
+		msg, _ := protocol.BuildConnect(reqID, protocol.NetworkTCP, "127.0.0.1", uint16(target.Port), nil)
+		c.send(t, msg)
+		if !random.fail.Load() {
+			c.recv(t)
+			return
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for h.Stats().EncryptFailed == before && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	closed := func(c *testClient) bool {
+		c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := c.conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	// 健康客户端的成功不会清零故障客户端的计数，反之亦然
+	random.fail.Store(true)
+	for i := 0; i < CryptoFailFastThreshold-1; i++ {
+		connect(failing)
+	}
+	connect(healthy)
+	random.fail.Store(false)
+	connect(healthy)
+	random.fail.Store(true)
+	connect(failing)
+	random.fail.Store(false)
+
+	if !closed(failing) {
+		t.Error("连续加密失败达到阈值的客户端应被关闭")
+	}
+	if closed(healthy) {
+		t.Error("其他客户端不应因别人的加密失败被关闭")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 接受连接但从不回应 CONNECT 的上游，拨号只能靠超时结束
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听上游失败: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	up, err := ParseUpstream("http://" + silent.Addr().String())
+	if err != nil {
+		t.Fatalf("解析上游代理失败: %v", err)
+	}
+	h := NewTCPHandler(cry, "error", WithUpstream(up), WithMaxDialTimeout(300*time.Millisecond))
+	defer h.Close()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"指定超时", 100 * time.Millisecond, 100 * time.Millisecond},
+		{"超出上限被截断", 60 * time.Second, 300 * time.Millisecond},
+		{"未指定使用默认值", 0, DefaultDialTimeout},
+	}
+	for _, tt := range tests {
+		connect, err := protocol.BuildConnectTimeout(1, protocol.NetworkTCP, "example.com", 443, tt.timeout, nil)
+		if err != nil {
+			t.Fatalf("%s: 构建失败: %v", tt.name, err)
+		}
+		req, err := protocol.ParseRequest(connect)
+		if err != nil {
+			t.Fatalf("%s: 解析失败: %v", tt.name, err)
+		}
+		if got := h.connectTimeout(req); got != tt.want {
+			t.Errorf("%s: 连接超时 = %v, 期望 %v", tt.name, got, tt.want)
+		}
+		if tt.timeout == 0 {
+			continue
+		}
+
+		// 实际拨号在截断后的超时内失败
+		writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+		start := time.Now()
+		resp, err := cry.Decrypt(h.handleConnect(connect, &mockConn{}, writer))
+		elapsed := time.Since(start)
+		if err != nil || resp[5] != protocol.StatusTimeout {
+			t.Errorf("%s: 期望 StatusTimeout: %v %v", tt.name, resp, err)
+		}
+		if elapsed < tt.want || elapsed > tt.want+time.Second {
+			t.Errorf("%s: 拨号耗时 %v，期望约 %v", tt.name, elapsed, tt.want)
+		}
+	}
+}
+
+// dnsAnswer 对 A 查询回答 ip，其他类型返回空应答
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	qend := 12
+	for qend < len(query) && query[qend] != 0 {
+		qend += int(query[qend]) + 1
+	}
+	qend += 5
+	if qend > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[qend-4:])
+
+	resp := append([]byte{}, query[:qend]...)
+	resp[2] = 0x85 // QR | AA | RD
+	resp[3] = 0x80 // RA, RCODE=0
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+func TestResolver(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 所有 A 查询都解析到本机的模拟 DNS 服务器
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听 DNS 失败: %v", err)
+	}
+	defer pc.Close()
+	var queries sync.Map
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Store(string(buf[12:n]), true)
+			pc.WriteTo(dnsAnswer(buf[:n], net.IPv4(127, 0, 0, 1)), addr)
+		}
+	}()
+
+	r, err := ParseResolver(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("解析 DNS 服务器失败: %v", err)
+	}
+	h := NewTCPHandler(cry, "error", WithResolver(r))
+	defer h.Close()
+
+	target := listenTarget(t)
+	connect, _ := protocol.BuildConnect(1, protocol.NetworkTCP, "phantom.test", uint16(target.Port), nil)
+	writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+	resp, err := cry.Decrypt(h.handleConnect(connect, &mockConn{}, writer))
+	if err != nil || resp[5] != protocol.StatusOK {
+		t.Fatalf("经自定义解析器连接失败: %v %v", resp, err)
+	}
+	resolved := false
+	queries.Range(func(key, _ any) bool {
+		resolved = resolved || strings.Contains(key.(string), "phantom")
+		return true
+	})
+	if !resolved {
+		t.Error("目标域名没有经过自定义解析器")
+	}
+
+	// DoH
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, net.IPv4(127, 0, 0, 2)))
+	}))
+	defer doh.Close()
+
+	addrs, err := newDoHResolver(doh.URL, doh.Client()).LookupHost(context.Background(), "phantom.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.2" {
+		t.Errorf("DoH 解析结果错误: %v %v", addrs, err)
+	}
+
+	for _, server := range []string{"", "udp://1.1.1.1", "tls://", "https://"} {
+		if _, err := ParseResolver(server); err == nil {
+			t.Errorf("无效的 DNS 服务器应该被拒绝: %q", server)
+		}
+	}
+	for _, server := range []string{"1.1.1.1", "[2606:4700::1111]:53", "2606:4700::1111", "tls://dns.example", "https://dns.example/dns-query"} {
+		if _, err := ParseResolver(server); err != nil {
+			t.Errorf("有效的 DNS 服务器被拒绝: %q: %v", server, err)
+		}
+	}
+}
+
+func TestFrameRateLimit(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	const rate = 50
+	h := NewTCPHandler(cry, "error", WithFrameRateLimit(rate))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer conn.Close()
+
+	// 大量无法解密的小帧，每处理一帧 DecryptFailed 加一
+	const frames = 3 * rate
+	start := time.Now()
+	writer := transport.NewFrameWriter(conn, time.Second)
+	for i := 0; i < frames; i++ {
+		if err := writer.WriteFrame([]byte{byte(i)}); err != nil {
+			t.Fatalf("发送失败: %v", err)
+		}
+	}
+
+	time.Sleep(time.Second)
+	processed := h.Stats().DecryptFailed
+	limit := rate + int64(rate*time.Since(start).Seconds()) + 5
+	if processed > limit || processed >= frames {
+		t.Errorf("处理速率未被限制: %d 帧 (上限约 %d)", processed, limit)
+	}
+
+	// 超出的帧被推迟而不是丢弃
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().DecryptFailed < frames && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if stats := h.Stats(); stats.DecryptFailed != frames || stats.FramesThrottled == 0 {
+		t.Errorf("限速后的统计错误: %+v", stats)
+	}
+}
+
+// eofConn 目标正常关闭，读取返回 io.EOF
+type eofConn struct{ mockConn }
+
+func (*eofConn) Read([]byte) (int, error) { return 0, io.EOF }
+
+// wakeConn Read 阻塞到 Close 被调用；Close 唤醒读取后稍等片刻才返回，让被唤醒的 readFromTarget 先执行
+type wakeConn struct {
+	mockConn
+	once    sync.Once
+	reading chan struct{}
+	done    chan struct{}
+}
+
+func newWakeConn() *wakeConn {
+	return &wakeConn{reading: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (w *wakeConn) Read([]byte) (int, error) {
+	close(w.reading)
+	<-w.done
+	return 0, net.ErrClosed
+}
+
+func (w *wakeConn) Close() error {
+	w.once.Do(func() {
+		close(w.done)
+		time.Sleep(50 * time.Millisecond)
+	})
+	return nil
+}
+
+func TestCloseReasonCodes(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithMaxConnLifetime(time.Minute))
+	defer h.Close()
+
+	tests := []struct {
+		name   string
+		target net.Conn
+		age    time.Duration // 距建立的时间
+		idle   time.Duration // 距最后活跃的时间
+		close  func(c *Conn)
+		want   byte
+	}{
+		{"空闲回收", &mockConn{}, time.Minute / 2, 10 * time.Minute, func(*Conn) { h.cleanup() }, protocol.CloseReasonIdleTimeout},
+		{"最长存活", &mockConn{}, 2 * time.Minute, 0, func(*Conn) { h.cleanup() }, protocol.CloseReasonMaxLifetime},
+		// 关闭目标会唤醒正在读取的 readFromTarget，关闭原因仍应是回收的原因
+		{"读取中空闲回收", newWakeConn(), time.Minute / 2, 10 * time.Minute, func(c *Conn) {
+			go h.readFromTarget(c)
+			<-c.Target.(*wakeConn).reading
+			h.cleanup()
+		}, protocol.CloseReasonIdleTimeout},
+		{"管理关闭", &mockConn{}, 0, 0, func(c *Conn) { h.CloseConn(c.ID) }, protocol.CloseReasonAdminClose},
+		{"目标关闭", &eofConn{}, 0, 0, h.readFromTarget, protocol.CloseReasonTargetClosed},
+		{"目标出错", &mockConn{}, 0, 0, h.readFromTarget, protocol.CloseReasonTargetError},
+	}
+	for i, tt := range tests {
+		client := &mockConn{}
+		c := &Conn{
+			ID:         uint32(100 + i),
+			Target:     tt.target,
+			ClientConn: client,
+			Writer:     transport.NewFrameWriter(client, time.Second),
+			CreatedAt:  time.Now().Add(-tt.age),
+			LastActive: time.Now().Add(-tt.idle),
+			creditCh:   make(chan struct{}, 1),
+		}
+		h.conns.Store(c.ID, c)
+		h.activeConns.Add(1)
+		tt.close(c)
+
+		frame, err := transport.NewFrameReader(&mockConn{readData: client.written(time.Second)}, 0).ReadFrame()
+		if err != nil {
+			t.Errorf("%s: 没有收到关闭通知: %v", tt.name, err)
+			continue
+		}
+		msg, err := cry.Decrypt(frame)
+		if err != nil {
+			t.Fatalf("%s: 解密失败: %v", tt.name, err)
+		}
+		req, err := protocol.ParseRequest(msg)
+		if err != nil || req.Type != protocol.TypeClose || req.ReqID != c.ID || req.CloseReason() != tt.want {
+			t.Errorf("%s: 关闭通知错误: %+v %v", tt.name, req, err)
+		}
+	}
+
+	// 客户端主动关闭不回发通知
+	client := &mockConn{}
+	c := &Conn{ID: 200, Target: &mockConn{}, ClientConn: client, Writer: transport.NewFrameWriter(client, time.Second)}
+	h.conns.Store(c.ID, c)
+	h.activeConns.Add(1)
+	h.handleDisconnect(protocol.BuildClose(c.ID))
+	if len(client.written(100*time.Millisecond)) != 0 {
+		t.Error("客户端主动关闭时不应回发关闭通知")
+	}
+}
+
+func TestUDPSourcePorts(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 目标记录收到的首个数据包的来源
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听目标失败: %v", err)
+	}
+	defer target.Close()
+	source := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 64)
+		if _, addr, err := target.ReadFrom(buf); err == nil {
+			source <- addr.(*net.UDPAddr)
+		}
+	}()
+
+	// 占用范围内的首选端口，映射应顺延到下一个端口
+	busy, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatalf("占用端口失败: %v", err)
+	}
+	defer busy.Close()
+	first := busy.LocalAddr().(*net.UDPAddr).Port
+	last := min(first+8, 65535)
+
+	h := NewTCPHandler(cry, "error", WithUDPSourcePorts(first, last))
+	defer h.Close()
+
+	reqID := uint32(last-first+1) * 7 // 首选端口为 first
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	connect, _ := protocol.BuildConnect(reqID, protocol.NetworkUDP, "127.0.0.1", uint16(targetAddr.Port), []byte("hi"))
+	writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+	resp, err := cry.Decrypt(h.handleConnect(connect, &mockConn{}, writer))
+	if err != nil || resp[5] != protocol.StatusOK {
+		t.Fatalf("连接 UDP 目标失败: %v %v", resp, err)
+	}
+
+	var from *net.UDPAddr
+	select {
+	case from = <-source:
+	case <-time.After(2 * time.Second):
+		t.Fatal("目标没有收到数据")
+	}
+	if from.Port <= first || from.Port > last {
+		t.Errorf("源端口 %d 不在映射范围 (%d, %d] 内", from.Port, first, last)
+	}
+
+	// 映射记录在连接信息中
+	conns := h.Conns()
+	if len(conns) != 1 || conns[0].ID != reqID {
+		t.Fatalf("连接信息错误: %+v", conns)
+	}
+	if _, port, _ := net.SplitHostPort(conns[0].Local); port != strconv.Itoa(from.Port) {
+		t.Errorf("记录的本地地址 %s 与实际源端口 %d 不一致", conns[0].Local, from.Port)
+	}
+}
+
+func TestUnknownTypeLimit(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	logs := captureLog(t)
+	const limit = 3
+	h := NewTCPHandler(cry, "info", WithUnknownTypeLimit(limit))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	unknown := []byte{0x7E, 0, 0, 0, 1}
+
+	// 未达到阈值时连接保持打开，已知类型的消息照常处理
+	for i := 0; i < limit-1; i++ {
+		client.send(t, unknown)
+	}
+	target := listenTarget(t)
+	client.send(t, buildConnect(1, target))
+	if _, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || status != protocol.StatusOK {
+		t.Fatalf("阈值之前连接应正常工作: status=0x%02x err=%v", status, err)
+	}
+
+	// 达到阈值后服务端关闭连接
+	client.send(t, unknown)
+	if _, err := client.reader.ReadFrame(); err == nil {
+		t.Fatal("达到阈值后连接应被关闭")
+	}
+	if got := h.Stats().UnknownFrames; got != limit {
+		t.Errorf("UnknownFrames = %d, 期望 %d", got, limit)
+	}
+	if !strings.Contains(logs.String(), "协议可能不兼容") {
+		t.Errorf("应输出关闭原因: %s", logs.String())
+	}
+}
+
+func TestResolveMessage(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, net.IPv4(192, 0, 2, 7)))
+	}))
+	defer doh.Close()
+
+	h := NewTCPHandler(cry, "error", WithResolver(newDoHResolver(doh.URL, doh.Client())))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+
+	client := dialTestClient(t, srv.Addr().String(), psk)
+	resolve, _ := protocol.BuildResolve(3, "phantom.test")
+	client.send(t, resolve)
+
+	resp := client.recv(t)
+	if resp[0] != protocol.TypeResolveResp {
+		t.Fatalf("应返回 ResolveResp: 0x%02x", resp[0])
+	}
+	reqID, status, payload, err := protocol.ParseResponse(resp)
+	if err != nil || reqID != 3 || status != protocol.StatusOK {
+		t.Fatalf("解析失败: id=%d status=0x%02x err=%v", reqID, status, err)
+	}
+	ips, err := protocol.ParseResolveAddrs(payload)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Errorf("解析结果错误: %v %v", ips, err)
+	}
+
+	// 格式错误的请求回复 StatusError
+	client.send(t, []byte{protocol.TypeResolve, 0, 0, 0, 4, 0})
+	if reqID, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || reqID != 4 || status != protocol.StatusError {
+		t.Errorf("格式错误的请求应返回 StatusError: id=%d status=0x%02x err=%v", reqID, status, err)
+	}
+}
+
+// TestResolveLimit 单个客户端同时进行的解析数有上限，被路由拒绝的域名不解析
+func TestResolveLimit(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// DoH 服务器在 release 关闭前挂起所有查询，记录同时进行的查询数
+	release := make(chan struct{})
+	var inflight, peak, queries atomic.Int64
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		query, _ := io.ReadAll(r.Body)
+		<-release
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, net.IPv4(192, 0, 2, 7)))
+	}))
+	defer doh.Close()
+
+	router, err := NewRouter([]Route{{Match: "*.blocked.test", Action: RouteReject}}, nil)
+	if err != nil {
+		t.Fatalf("创建路由失败: %v", err)
+	}
+	h := NewTCPHandler(cry, "error", WithResolver(newDoHResolver(doh.URL, doh.Client())), WithRouter(router))
+	defer h.Close()
+	srv := transport.NewTCPServer("127.0.0.1:0", h, "error")
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer srv.Stop()
+	client := dialTestClient(t, srv.Addr().String(), psk)
+
+	resolve, _ := protocol.BuildResolve(1, "www.blocked.test")
+	client.send(t, resolve)
+	if _, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || status != protocol.StatusNotAllowed {
+		t.Fatalf("被拒绝的域名应返回 StatusNotAllowed: status=0x%02x err=%v", status, err)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Fatalf("被拒绝的域名不应查询: %d", n)
+	}
+
+	const total = 4 * maxPendingResolves
+	for i := 0; i < total; i++ {
+		resolve, _ := protocol.BuildResolve(uint32(100+i), "host"+strconv.Itoa(i)+".test")
+		client.send(t, resolve)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// 每次解析同时查询 A 与 AAAA；后台 maxPendingResolves 个加上就地进行的 1 个
+	if p := peak.Load(); p > 2*(maxPendingResolves+1) {
+		t.Errorf("同时进行的查询过多: %d", p)
+	}
+	close(release)
+
+	for i := 0; i < total; i++ {
+		if _, status, _, err := protocol.ParseResponse(client.recv(t)); err != nil || status != protocol.StatusOK {
+			t.Fatalf("解析失败: status=0x%02x err=%v", status, err)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	psk, err := crypto.GeneratePSK()
+	if err != nil {
+		t.Fatalf("生成 PSK 失败: %v", err)
+	}
+
+	cry, err := crypto.New(psk, 30)
+	if err != nil {
+		t.Fatalf("创建 Crypto 失败: %v", err)
+	}
+
+	// 每个上游代理只拒绝经自己路由的那个目标，由此判断连接走了哪个出口
+	viaA, viaB, direct := listenTarget(t), listenTarget(t), listenTarget(t)
+	proxyA := mockConnectProxy(t, "a", "a", viaA.String())
+	proxyB := mockConnectProxy(t, "b", "b", viaB.String())
+	router, err := NewRouter([]Route{
+		{Match: viaA.IP.String() + "/32", Action: "a"}, // 本地目标都在 127.0.0.1，以 IP 给出时都经上游 A
+		{Match: "blocked.invalid", Action: RouteReject},
+		{Match: "*.b.invalid", Action: "b"},
+	}, map[string]string{
+		"a": "http://a:a@" + proxyA,
+		"b": "http://b:b@" + proxyB,
+	})
+	if err != nil {
+		t.Fatalf("解析路由失败: %v", err)
+	}
+
+	h := NewTCPHandler(cry, "error", WithRouter(router))
+	defer h.Close()
+	writer := transport.NewFrameWriter(&mockConn{}, time.Second)
+	connect := func(msg []byte) byte {
+		t.Helper()
+		resp, err := cry.Decrypt(h.handleConnect(msg, &mockConn{}, writer))
+		if err != nil {
+			t.Fatalf("解密响应失败: %v", err)
+		}
+		return resp[5]
+	}
+
+	// 经上游 A: 被 A 拒绝 (直连或经 B 都会成功)
+	if status := connect(buildConnect(1, viaA)); status != protocol.StatusNotAllowed {
+		t.Errorf("viaA 应经上游 A: status=0x%02x", status)
+	}
+	// 上游 A 只拒绝 viaA，其他目标正常转发
+	if status := connect(buildConnect(2, direct)); status != protocol.StatusOK {
+		t.Errorf("经上游 A 连接 direct 应成功: status=0x%02x", status)
+	}
+	// 域名拒绝规则不拨号，否则会得到 DNS 失败
+	if status := connect(buildConnectDomain(3, "Blocked.Invalid.", 80)); status != protocol.StatusNotAllowed {
+		t.Errorf("blocked.invalid 应被拒绝: status=0x%02x", status)
+	}
+	if status := connect(buildConnectDomain(4, "sub.blocked.invalid", 80)); status != protocol.StatusNotAllowed {
+		t.Errorf("子域名应同样被拒绝: status=0x%02x", status)
+	}
+
+	// 子域名规则经上游 B，由 B 解析失败返回 502
+	if status := connect(buildConnectDomain(5, "x.b.invalid", uint16(viaB.Port))); status != protocol.StatusConnectFailed {
+		t.Errorf("x.b.invalid 应经上游 B: status=0x%02x", status)
+	}
+	// *.b.invalid 不匹配 b.invalid 本身，直连时 DNS 失败
+	if status := connect(buildConnectDomain(6, "b.invalid", 80)); status != protocol.StatusDNSFailed {
+		t.Errorf("b.invalid 应直连: status=0x%02x", status)
+	}
+
+	for _, tc := range []struct {
+		routes    []Route
+		upstreams map[string]string
+	}{
+		{[]Route{{Match: "example.com", Action: "missing"}}, nil},
+		{[]Route{{Match: "10.0.0.0/33", Action: RouteDirect}}, nil},
+		{[]Route{{Match: "", Action: RouteDirect}}, nil},
+		{[]Route{{Match: "a.*.com", Action: RouteDirect}}, nil},
+		{nil, map[string]string{"direct": "http://127.0.0.1:8080"}},
+		{nil, map[string]string{"a": "socks5://127.0.0.1:1080"}},
+	} {
+		if _, err := NewRouter(tc.routes, tc.upstreams); err == nil {
+			t.Errorf("无效配置应被拒绝: %+v %v", tc.routes, tc.upstreams)
+		}
+	}
+}
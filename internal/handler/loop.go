@@ -0,0 +1,97 @@
+// internal/handler/loop.go
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// errLoopDetected 目标指向服务端自身，继续拨号会形成代理环路
+var errLoopDetected = errors.New("目标指向服务端自身")
+
+// selfAddr 服务端自身的一个监听地址，ip 为 nil 表示监听全部地址
+type selfAddr struct {
+	ip   net.IP
+	port string
+}
+
+func parseSelfAddrs(addrs []string) ([]selfAddr, error) {
+	var result []selfAddr
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的自身地址 %q: %w", addr, err)
+		}
+		var ip net.IP
+		if host != "" {
+			if ip = net.ParseIP(host); ip == nil {
+				return nil, fmt.Errorf("自身地址必须是 IP: %q", addr)
+			}
+			if ip.IsUnspecified() {
+				ip = nil
+			}
+		}
+		result = append(result, selfAddr{ip: ip, port: port})
+	}
+	return result, nil
+}
+
+// ValidateSelfAddrs 校验自身地址列表的格式
+func ValidateSelfAddrs(addrs []string) error {
+	_, err := parseSelfAddrs(addrs)
+	return err
+}
+
+// isSelf 判断解析后的目标地址是否为服务端自身
+func (h *TCPHandler) isSelf(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, self := range h.selfAddrs {
+		if self.port != port {
+			continue
+		}
+		if self.ip != nil {
+			if self.ip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		// 监听全部地址时，任何本机地址都指向自身
+		if ip.IsLoopback() || ip.IsUnspecified() || isLocalIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialControl 在建立连接前检查解析后的地址，域名解析到自身的情况也能拦截
+func (h *TCPHandler) dialControl(network, address string, _ syscall.RawConn) error {
+	if strings.HasPrefix(network, "tcp") && h.isSelf(address) {
+		return errLoopDetected
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// internal/handler/ratelimit.go
+
+package handler
+
+import (
+	"context"
+	"time"
+)
+
+// frameLimiter 令牌桶，限制单个客户端连接每秒处理的帧数
+// 超出速率的帧不丢弃，而是推迟读取，由 TCP 背压让客户端放慢发送
+// 只在处理该连接的 goroutine 中使用，无需加锁
+type frameLimiter struct {
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newFrameLimiter 创建每秒 perSec 帧、允许突发 perSec 帧的限速器，perSec <= 0 时返回 nil
+func newFrameLimiter(perSec int) *frameLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return &frameLimiter{
+		rate:   float64(perSec),
+		burst:  float64(perSec),
+		tokens: float64(perSec),
+		last:   time.Now(),
+	}
+}
+
+// wait 取得一个令牌，不足时等待；返回是否被限速，ctx 取消时返回 ctx 的错误
+func (l *frameLimiter) wait(ctx context.Context) (bool, error) {
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return false, nil
+	}
+
+	// 欠下的令牌在下次调用时由补充抵消
+	timer := time.NewTimer(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
@@ -0,0 +1,237 @@
+// internal/handler/resolver.go
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anthropics/phantom-server/internal/protocol"
+)
+
+const (
+	// dnsQueryTimeout 单次 DoH 查询的默认超时，解析器未设置截止时间时使用
+	dnsQueryTimeout = 5 * time.Second
+	// maxDNSMessageSize DNS 消息的最大长度
+	maxDNSMessageSize = 65535
+)
+
+// ParseResolver 解析出站 DNS 服务器配置，返回解析目标域名使用的 Resolver
+// 支持的格式:
+//
+//	host[:port]          普通 DNS，默认端口 53
+//	tls://host[:port]    DNS over TLS，默认端口 853
+//	https://host/path    DNS over HTTPS (RFC 8484)
+func ParseResolver(server string) (*net.Resolver, error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("DoH 地址无效: %q", server)
+		}
+		return newDoHResolver(u.String(), &http.Client{}), nil
+
+	case strings.HasPrefix(server, "tls://"):
+		addr, host, err := dnsServerAddr(strings.TrimPrefix(server, "tls://"), "853")
+		if err != nil {
+			return nil, err
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := tls.Dialer{Config: &tls.Config{ServerName: host}}
+				return d.DialContext(ctx, "tcp", addr)
+			},
+		}, nil
+
+	case strings.Contains(server, "://"):
+		return nil, fmt.Errorf("不支持的 DNS 服务器协议: %q", server)
+
+	default:
+		addr, _, err := dnsServerAddr(server, "53")
+		if err != nil {
+			return nil, err
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}, nil
+	}
+}
+
+// dnsServerAddr 补全 DNS 服务器的默认端口，返回 host:port 与 host
+func dnsServerAddr(server, defaultPort string) (addr, host string, err error) {
+	if server == "" {
+		return "", "", fmt.Errorf("DNS 服务器地址为空")
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		// 没有端口，可能是裸 IPv6 地址
+		host, port = strings.Trim(server, "[]"), defaultPort
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("DNS 服务器地址无效: %q", server)
+	}
+	return net.JoinHostPort(host, port), host, nil
+}
+
+// newDoHResolver 创建通过 DoH 查询的 Resolver
+// Go 的解析器对非 PacketConn 的连接使用 TCP 格式 (2 字节长度前缀)，dohConn 据此转换
+func newDoHResolver(endpoint string, client *http.Client) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+		},
+	}
+}
+
+// dohConn 把写入的 DNS 查询以 POST 发往 DoH 服务器，读取时返回响应
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	deadline time.Time
+
+	query    bytes.Buffer
+	response bytes.Reader
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		if err := c.roundTrip(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+// roundTrip 发送缓冲中的一条完整查询
+func (c *dohConn) roundTrip() error {
+	if c.query.Len() < 2 {
+		return io.EOF
+	}
+	n := int(binary.BigEndian.Uint16(c.query.Bytes()))
+	if c.query.Len() < 2+n {
+		return fmt.Errorf("DNS 查询不完整")
+	}
+	msg := c.query.Next(2 + n)[2:]
+
+	ctx, cancel := c.queryContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DoH 服务器返回 %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDNSMessageSize {
+		return fmt.Errorf("DoH 响应过大")
+	}
+
+	c.response.Reset(append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...))
+	return nil
+}
+
+func (c *dohConn) queryContext() (context.Context, context.CancelFunc) {
+	if !c.deadline.IsZero() {
+		return context.WithDeadline(c.ctx, c.deadline)
+	}
+	return context.WithTimeout(c.ctx, dnsQueryTimeout)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.endpoint) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.endpoint) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dohAddr DoH 服务器的地址，用于满足 net.Conn 接口
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+const (
+	// maxResolveAddrs 一次解析结果最多返回的地址数
+	maxResolveAddrs = 16
+	// maxPendingResolves 单个客户端连接在后台同时进行的解析数
+	maxPendingResolves = 8
+)
+
+// handleResolve 用服务端的解析器解析客户端请求的域名，返回加密后的 TypeResolveResp
+// 客户端拿到地址后按 IP 发起 Connect，省去本地 DNS 查询的往返
+// 查询可能耗时较长，调用方应在单独的协程中执行
+func (h *TCPHandler) handleResolve(ctx context.Context, data []byte, clientConn net.Conn) []byte {
+	if len(data) < 5 {
+		h.logDebug("Resolve 数据太短: %d", len(data))
+		return nil
+	}
+
+	reqID := binary.BigEndian.Uint32(data[1:5])
+	status := byte(protocol.StatusOK)
+	var ips []net.IP
+	req, err := protocol.ParseRequest(data)
+	if err != nil {
+		h.logDebug("解析 Resolve 失败: %v", err)
+		status = protocol.StatusError
+	} else if h.routeRejected(req.Address) {
+		// 与 Connect 一致，被路由规则拒绝的域名不代为解析
+		h.logDebug("路由规则拒绝解析: %s", req.Address)
+		status = protocol.StatusNotAllowed
+	} else {
+		resolver := h.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		ctx, cancel := context.WithTimeout(ctx, h.dialTimeout)
+		ips, err = resolver.LookupIP(ctx, "ip", req.Address)
+		cancel()
+		if err != nil {
+			h.logDebug("解析域名失败 %s: %v", req.Address, err)
+			status = protocol.StatusDNSFailed
+		} else {
+			h.logDebug("解析域名: %s -> %v", req.Address, ips)
+		}
+		if len(ips) > maxResolveAddrs {
+			ips = ips[:maxResolveAddrs]
+		}
+	}
+
+	encrypted, err := h.encrypt(protocol.BuildResolveResp(reqID, status, ips), clientConn)
+	if err != nil {
+		h.logDebug("加密解析结果失败: %v", err)
+		return nil
+	}
+	return encrypted
+}
@@ -0,0 +1,143 @@
+// internal/handler/route.go
+
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 路由规则的内置出口，其他出口名称引用 upstreams 中定义的上游代理
+const (
+	RouteDirect = "direct" // 直接连接目标
+	RouteReject = "reject" // 拒绝，回复 StatusNotAllowed
+)
+
+// Route 一条路由规则，目标匹配 Match 时经 Action 指定的出口连接
+// Match 可以是:
+//
+//	example.com          该域名及其所有子域名
+//	*.example.com        只匹配子域名
+//	10.0.0.0/8, 1.2.3.4  CIDR 或单个 IP，只匹配以 IP 给出的目标 (不为匹配而解析域名)
+type Route struct {
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"`
+}
+
+// Router 按规则为目标选择出口，第一条匹配的规则生效
+type Router struct {
+	rules []routeRule
+}
+
+type routeRule struct {
+	domain      string     // 小写、无末尾点
+	subdomainly bool       // *.domain 形式，不匹配 domain 本身
+	network     *net.IPNet // CIDR 规则
+	egress      egress
+}
+
+// egress 连接目标的出口
+type egress struct {
+	reject   bool
+	upstream *Upstream // nil 表示直连
+}
+
+// NewRouter 解析路由规则，upstreams 为出口名称到上游代理地址 (http://...) 的映射
+func NewRouter(routes []Route, upstreams map[string]string) (*Router, error) {
+	named := make(map[string]*Upstream, len(upstreams))
+	for name, rawURL := range upstreams {
+		if name == RouteDirect || name == RouteReject {
+			return nil, fmt.Errorf("上游名称 %q 与内置出口冲突", name)
+		}
+		up, err := ParseUpstream(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("上游 %s: %w", name, err)
+		}
+		named[name] = up
+	}
+
+	r := &Router{rules: make([]routeRule, 0, len(routes))}
+	for i, route := range routes {
+		rule, err := parseRouteMatch(route.Match)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 条路由: %w", i+1, err)
+		}
+		switch route.Action {
+		case RouteDirect:
+		case RouteReject:
+			rule.egress.reject = true
+		default:
+			up, ok := named[route.Action]
+			if !ok {
+				return nil, fmt.Errorf("第 %d 条路由: 未定义的出口 %q", i+1, route.Action)
+			}
+			rule.egress.upstream = up
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func parseRouteMatch(match string) (routeRule, error) {
+	if match == "" {
+		return routeRule{}, fmt.Errorf("匹配条件为空")
+	}
+	if strings.Contains(match, "/") {
+		_, network, err := net.ParseCIDR(match)
+		if err != nil {
+			return routeRule{}, fmt.Errorf("CIDR 无效: %q", match)
+		}
+		return routeRule{network: network}, nil
+	}
+	if ip := net.ParseIP(match); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return routeRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+
+	rule := routeRule{domain: strings.ToLower(strings.TrimSuffix(match, "."))}
+	if rest, ok := strings.CutPrefix(rule.domain, "*."); ok {
+		rule.domain, rule.subdomainly = rest, true
+	}
+	if rule.domain == "" || strings.Contains(rule.domain, "*") {
+		return routeRule{}, fmt.Errorf("域名无效: %q", match)
+	}
+	return rule, nil
+}
+
+// route 返回目标主机 (域名或 IP，不含端口) 命中的出口，没有规则匹配时 ok 为 false
+func (r *Router) route(host string) (e egress, ok bool) {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range r.rules {
+		if rule.matches(host, ip) {
+			return rule.egress, true
+		}
+	}
+	return egress{}, false
+}
+
+// routeRejected 判断目标主机是否命中拒绝规则
+func (h *TCPHandler) routeRejected(host string) bool {
+	if h.router == nil {
+		return false
+	}
+	e, ok := h.router.route(host)
+	return ok && e.reject
+}
+
+func (rule *routeRule) matches(host string, ip net.IP) bool {
+	if rule.network != nil {
+		return ip != nil && rule.network.Contains(ip)
+	}
+	if ip != nil {
+		return false
+	}
+	if host == rule.domain {
+		return !rule.subdomainly
+	}
+	return strings.HasSuffix(host, "."+rule.domain)
+}
@@ -4,11 +4,17 @@ package handler
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/anthropics/phantom-server/internal/crypto"
@@ -22,33 +28,420 @@ type Conn struct {
 	Target     net.Conn
 	ClientConn net.Conn
 	Writer     *transport.FrameWriter
+	TargetAddr string
+	CreatedAt  time.Time
 	LastActive time.Time
 	Network    byte
 	closed     bool
 	mu         sync.Mutex
+
+	bytesUp   atomic.Int64 // 客户端 -> 目标
+	bytesDown atomic.Int64 // 目标 -> 客户端
+
+	credit   int64         // 流控: 剩余可发给客户端的字节数，受 mu 保护
+	creditCh chan struct{} // 额度增加或连接关闭时唤醒 readFromTarget
+}
+
+// close 标记连接关闭并关闭目标连接，唤醒等待流控额度的读协程
+func (c *Conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	if c.Target != nil {
+		c.Target.Close()
+	}
+	c.mu.Unlock()
+	c.wake()
+}
+
+func (c *Conn) wake() {
+	select {
+	case c.creditCh <- struct{}{}:
+	default:
+	}
+}
+
+// 连接关闭原因，用于访问日志
+const (
+	reasonClientClose = "client_close"
+	reasonTargetClose = "target_close"
+	reasonTargetError = "target_error"
+	reasonClientWrite = "client_write_failed"
+	reasonIdleTimeout = "idle_timeout"
+	reasonMaxLifetime = "max_lifetime"
+	reasonAdminClose  = "admin_close"
+	reasonShutdown    = "shutdown"
+	reasonReplaced    = "replaced"
+)
+
+// closeReasonCodes 由服务端发起、需要通知客户端的关闭原因及其协议编码
+// 客户端发起的关闭、写客户端失败和替换不需要通知
+var closeReasonCodes = map[string]byte{
+	reasonTargetClose: protocol.CloseReasonTargetClosed,
+	reasonTargetError: protocol.CloseReasonTargetError,
+	reasonIdleTimeout: protocol.CloseReasonIdleTimeout,
+	reasonMaxLifetime: protocol.CloseReasonMaxLifetime,
+	reasonAdminClose:  protocol.CloseReasonAdminClose,
+}
+
+// ConnInfo 连接快照，用于运行时查看
+type ConnInfo struct {
+	ID         uint32    `json:"id"`
+	Network    string    `json:"network"`
+	Target     string    `json:"target"`
+	Client     string    `json:"client"`
+	Local      string    `json:"local"` // 连接目标使用的本地地址
+	LastActive time.Time `json:"last_active"`
+}
+
+// Stats Handler 统计信息
+type Stats struct {
+	ActiveConns     int64 `json:"active_conns"`
+	TotalConns      int64 `json:"total_conns"`
+	ConnectFailed   int64 `json:"connect_failed"`
+	DecryptFailed   int64 `json:"decrypt_failed"`
+	EncryptFailed   int64 `json:"encrypt_failed"`
+	BytesToTarget   int64 `json:"bytes_to_target"`
+	BytesFromTarget int64 `json:"bytes_from_target"`
+	MemoryReserved  int64 `json:"memory_reserved"`
+	FramesThrottled int64 `json:"frames_throttled"`
+	UnknownFrames   int64 `json:"unknown_frames"`
+
+	Windows    crypto.WindowStats `json:"windows"`     // 解密成功的时间窗口分布
+	NonceCache crypto.CacheStats  `json:"nonce_cache"` // 重放检测缓存的大小
+}
+
+// client 一条客户端连接的状态
+type client struct {
+	writer        *transport.FrameWriter
+	encryptStreak atomic.Int64 // 发往该客户端的消息连续加密失败的次数，成功后清零
 }
 
 // TCPHandler 处理 TCP 代理请求
 type TCPHandler struct {
 	crypto   *crypto.Crypto
-	conns    sync.Map // map[uint32]*Conn
-	logLevel string
+	conns    sync.Map     // map[uint32]*Conn
+	clients  sync.Map     // map[net.Conn]*client
+	logLevel atomic.Value // string
+
+	done     chan struct{} // Close 时关闭，通知 cleanupLoop 退出
+	doneOnce sync.Once
+
+	maxConnLifetime time.Duration
+	cleanupInterval time.Duration
+	maxConns        int
+	accessLog       bool
+	dialTimeout     time.Duration
+	maxDialTimeout  time.Duration
+	writeTimeout    time.Duration
+	frameTimeout    time.Duration
+	compression     bool
+	allowedNetworks map[byte]bool // nil 表示全部允许
+	flowWindow      int64         // 流控初始额度，0 表示不做流控
+	probeDecoy      string
+	selfAddrs       []selfAddr
+	memoryBudget    int64
+	frameRate       int // 每个客户端连接每秒处理的最大帧数，0 表示不限制
+	unknownLimit    int // 单个客户端连接允许的未知类型帧数，0 表示不限制
+	upstream        *Upstream
+	router          *Router
+	resolver        *net.Resolver // nil 表示使用系统解析器
+	udpPortFirst    int           // UDP 目标的源端口范围，0 表示由系统分配
+	udpPortLast     int
+	cryptoFailFast  bool
+	decoyHoldMax    time.Duration
+
+	activeConns     atomic.Int64
+	memoryReserved  atomic.Int64
+	totalConns      atomic.Int64
+	connectFailed   atomic.Int64
+	decryptFailed   atomic.Int64
+	encryptFailed   atomic.Int64
+	bytesToTarget   atomic.Int64
+	bytesFromTarget atomic.Int64
+	framesThrottled atomic.Int64
+	unknownFrames   atomic.Int64
+}
+
+const (
+	// DefaultCleanupInterval 默认的超时连接清理间隔
+	DefaultCleanupInterval = 30 * time.Second
+	// BusyRetryAfter 因资源限制拒绝连接时建议客户端等待的时间
+	BusyRetryAfter = 5 * time.Second
+	// DefaultDialTimeout 默认的目标连接超时
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultMaxDialTimeout 客户端在 Connect 中指定连接超时时允许的上限
+	DefaultMaxDialTimeout = 30 * time.Second
+	// CryptoFailFastThreshold fail-fast 策略下关闭客户端连接前允许的连续加密失败 (或密钥不可用的解密失败) 次数
+	CryptoFailFastThreshold = 3
+)
+
+// 内存预算按固定缓冲估算每个连接的开销
+const (
+	// targetReadBufSize readFromTarget 的读缓冲大小
+	targetReadBufSize = 32 * 1024
+	// clientMemCost 每个客户端连接: 帧读、写缓冲与复用的解密缓冲
+	clientMemCost = 3 * (transport.MaxPacketSize + transport.LengthPrefixSize)
+	// connMemCost 每个代理连接: 读缓冲加协程栈、socket 等开销
+	connMemCost = targetReadBufSize + 16*1024
+)
+
+// Option TCPHandler 配置项
+type Option func(*TCPHandler)
+
+// WithMaxConnLifetime 限制单个连接从建立起的最长存活时间，不论是否活跃
+// 超过后关闭连接并通知客户端，0 表示不限制
+func WithMaxConnLifetime(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		h.maxConnLifetime = d
+	}
+}
+
+// WithCleanupInterval 设置超时连接的清理间隔
+func WithCleanupInterval(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		if d > 0 {
+			h.cleanupInterval = d
+		}
+	}
+}
+
+// WithMaxConns 限制同时活跃的代理连接数，超出时返回 StatusBusy，0 表示不限制
+func WithMaxConns(n int) Option {
+	return func(h *TCPHandler) {
+		h.maxConns = n
+	}
+}
+
+// WithAccessLog 开启访问日志：每个连接结束时在 info 级别输出一行汇总
+func WithAccessLog(enabled bool) Option {
+	return func(h *TCPHandler) {
+		h.accessLog = enabled
+	}
+}
+
+// WithDialTimeout 设置连接目标的超时时间
+func WithDialTimeout(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		if d > 0 {
+			h.dialTimeout = d
+		}
+	}
+}
+
+// WithMaxDialTimeout 设置客户端在 Connect 中指定连接超时时允许的上限，超出的值被截断
+func WithMaxDialTimeout(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		if d > 0 {
+			h.maxDialTimeout = d
+		}
+	}
+}
+
+// WithResolver 设置解析目标域名使用的 DNS 解析器，nil 表示使用系统解析器
+// 经上游代理连接的 TCP 目标由代理负责解析，不经过该解析器
+func WithResolver(r *net.Resolver) Option {
+	return func(h *TCPHandler) {
+		h.resolver = r
+	}
+}
+
+// WithFrameRateLimit 限制每个客户端连接每秒处理的帧数，0 表示不限制
+// 防止大量小帧让单个连接的解密/解析循环占满 CPU；超出的帧被推迟而不是丢弃
+func WithFrameRateLimit(perSec int) Option {
+	return func(h *TCPHandler) {
+		if perSec >= 0 {
+			h.frameRate = perSec
+		}
+	}
+}
+
+// WithUDPSourcePorts 连接 UDP 目标时从 [first, last] 中绑定源端口
+// 首选端口由连接 ID 映射 (first + ID % 范围大小)，被占用时依次尝试后续端口；
+// 实际使用的本地地址记录在 Conns 的 Local 字段中。范围无效时不生效
+func WithUDPSourcePorts(first, last int) Option {
+	return func(h *TCPHandler) {
+		if first > 0 && first <= last && last <= 65535 {
+			h.udpPortFirst, h.udpPortLast = first, last
+		}
+	}
+}
+
+// WithUnknownTypeLimit 单个客户端连接收到 n 个类型未知的帧后关闭该连接，0 表示只计数不关闭
+// 能解密却无法识别类型，通常意味着客户端协议版本不兼容或数据损坏
+func WithUnknownTypeLimit(n int) Option {
+	return func(h *TCPHandler) {
+		if n >= 0 {
+			h.unknownLimit = n
+		}
+	}
+}
+
+// WithCompression 开启负载压缩：发往客户端的数据在加密前尝试 DEFLATE 压缩，
+// 并接受客户端发来的压缩数据帧
+//
+// 注意：攻击者若能向同一连接注入可控明文并观察密文长度，压缩会泄露
+// 机密内容（CRIME/BREACH 类攻击），因此默认关闭，只应在流量不混合
+// 机密与攻击者可控数据时开启
+func WithCompression(enabled bool) Option {
+	return func(h *TCPHandler) {
+		h.compression = enabled
+	}
+}
+
+// WithAllowedNetworks 限制允许代理的网络类型 (protocol.NetworkTCP/NetworkUDP)，
+// 其余类型的 Connect 返回 StatusNotAllowed；不设置则全部允许
+func WithAllowedNetworks(networks ...byte) Option {
+	return func(h *TCPHandler) {
+		h.allowedNetworks = make(map[byte]bool, len(networks))
+		for _, n := range networks {
+			h.allowedNetworks[n] = true
+		}
+	}
+}
+
+// WithWriteTimeout 设置向客户端写入单帧的超时时间
+// 客户端停止读取超过该时间后，整个客户端连接会被关闭
+func WithWriteTimeout(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		if d > 0 {
+			h.writeTimeout = d
+		}
+	}
+}
+
+// WithFrameTimeout 设置收到帧长度前缀后读完帧体的超时
+// 对端只发长度不发数据时按协议错误断开，而不是等到 5 分钟的空闲超时
+func WithFrameTimeout(d time.Duration) Option {
+	return func(h *TCPHandler) {
+		if d > 0 {
+			h.frameTimeout = d
+		}
+	}
+}
+
+// WithMemoryBudget 设置连接缓冲的总内存预算 (字节)，按固定开销估算每个连接
+// 超出时新的客户端连接直接关闭、新的代理连接返回 StatusBusy，0 表示不限制
+func WithMemoryBudget(bytes int64) Option {
+	return func(h *TCPHandler) {
+		h.memoryBudget = bytes
+	}
+}
+
+// WithUpstream 通过上游 HTTP 代理 (CONNECT) 连接 TCP 目标，nil 表示直连
+// UDP 目标无法经 CONNECT 转发，仍然直连
+func WithUpstream(up *Upstream) Option {
+	return func(h *TCPHandler) {
+		h.upstream = up
+	}
+}
+
+// WithRouter 按路由规则为目标选择出口 (直连、某个上游代理或拒绝)
+// 没有规则匹配的目标按 WithUpstream 的设置连接；与上游一样，UDP 目标不经上游代理
+func WithRouter(r *Router) Option {
+	return func(h *TCPHandler) {
+		h.router = r
+	}
+}
+
+// WithCryptoFailFast 设置加解密本地故障的处理策略
+// 默认 (false) 丢弃该消息并计数；开启后连续 CryptoFailFastThreshold 次加密失败，
+// 或连续 CryptoFailFastThreshold 次因会话密钥不可用 (crypto.ErrKey) 解密失败，
+// 即关闭对应的客户端连接并输出错误日志，让持续性的故障尽快暴露而不是静默丢包
+// 数据包本身无效导致的解密失败不计入
+func WithCryptoFailFast(enabled bool) Option {
+	return func(h *TCPHandler) {
+		h.cryptoFailFast = enabled
+	}
+}
+
+// WithFlowControl 开启按连接的信用流控：每个连接初始可向客户端发送 window 字节
+// (压缩前的负载长度)，用完后暂停读取目标，直到客户端发送 TypeWindowUpdate 追加额度
+// 这样一个消费缓慢的连接不会占满共享的客户端 socket。需要客户端支持，0 表示关闭
+func WithFlowControl(window int) Option {
+	return func(h *TCPHandler) {
+		h.flowWindow = int64(window)
+	}
+}
+
+// WithProbeDecoy 设置对主动探测的诱饵行为 (DecoyHTTP/DecoyHold)
+// 客户端在发出首个合法帧之前连续发送无法解密的数据、帧格式错误或
+// 迟迟不发数据时，不再静默等待，而是表现得像一个普通服务
+func WithProbeDecoy(mode string) Option {
+	return func(h *TCPHandler) {
+		h.probeDecoy = mode
+	}
+}
+
+// WithSelfAddrs 设置服务端自身的地址 (host:port)，拒绝拨号到这些地址以防代理环路
+// host 为空或为未指定地址时匹配本机所有地址；无法解析的地址 (如域名) 被跳过，
+// 调用方应先用 ValidateSelfAddrs 校验
+func WithSelfAddrs(addrs ...string) Option {
+	return func(h *TCPHandler) {
+		h.selfAddrs = nil
+		for _, addr := range addrs {
+			if parsed, err := parseSelfAddrs([]string{addr}); err == nil {
+				h.selfAddrs = append(h.selfAddrs, parsed...)
+			}
+		}
+	}
 }
 
 // NewTCPHandler 创建新的 TCP Handler
-func NewTCPHandler(c *crypto.Crypto, logLevel string) *TCPHandler {
+func NewTCPHandler(c *crypto.Crypto, logLevel string, opts ...Option) *TCPHandler {
 	h := &TCPHandler{
-		crypto:   c,
-		logLevel: logLevel,
+		crypto:          c,
+		cleanupInterval: DefaultCleanupInterval,
+		dialTimeout:     DefaultDialTimeout,
+		maxDialTimeout:  DefaultMaxDialTimeout,
+		writeTimeout:    transport.WriteTimeout,
+		frameTimeout:    transport.FrameBodyTimeout,
+		decoyHoldMax:    defaultDecoyHoldMax,
+		done:            make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.logLevel.Store(logLevel)
 	go h.cleanupLoop()
 	return h
 }
 
+// SetLogLevel 运行时修改日志级别
+func (h *TCPHandler) SetLogLevel(level string) {
+	h.logLevel.Store(level)
+}
+
 // HandleConnection 实现 PacketHandler 接口，处理单个客户端 TCP 连接
 func (h *TCPHandler) HandleConnection(ctx context.Context, conn net.Conn) {
-	reader := transport.NewFrameReader(conn, transport.ReadTimeout)
-	writer := transport.NewFrameWriter(conn, transport.WriteTimeout)
+	// 在分配帧缓冲之前做准入检查
+	if !h.reserveMemory(clientMemCost) {
+		h.logDebug("内存预算已满，拒绝客户端: %s", conn.RemoteAddr())
+		return
+	}
+	defer h.releaseMemory(clientMemCost)
+
+	readTimeout := transport.ReadTimeout
+	if h.probeDecoy != DecoyNone {
+		readTimeout = probeFirstFrameTimeout
+	}
+	reader := transport.NewFrameReader(conn, readTimeout)
+	reader.SetBodyTimeout(h.frameTimeout)
+	authenticated := false
+	probeFailures := 0
+	unknownFrames := 0
+	keyStreak := int64(0) // 因会话密钥不可用连续解密失败的次数，解密成功后清零
+	writer := transport.NewFrameWriter(conn, h.writeTimeout)
+	// Decrypt 不保留输入，帧缓冲可以在整个连接内复用
+	frameBuf := make([]byte, transport.MaxPacketSize)
+	limiter := newFrameLimiter(h.frameRate)
+	resolving := make(chan struct{}, maxPendingResolves)
+
+	h.clients.Store(conn, &client{writer: writer})
+	defer h.clients.Delete(conn)
+
+	// 读取可能阻塞到读超时 (5 分钟)，ctx 取消时直接关闭连接让读取立即返回
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	h.logDebug("处理新连接: %s", conn.RemoteAddr())
 
@@ -60,23 +453,58 @@ func (h *TCPHandler) HandleConnection(ctx context.Context, conn net.Conn) {
 		}
 
 		// 读取加密帧
-		frame, err := reader.ReadFrame()
+		n, err := reader.ReadFrameInto(frameBuf)
 		if err != nil {
+			if !authenticated && h.probeDecoy != DecoyNone && err != io.EOF {
+				h.decoy(conn)
+				return
+			}
 			if err != io.EOF {
 				h.logDebug("读取帧失败 [%s]: %v", conn.RemoteAddr(), err)
 			}
 			return
 		}
 
+		frame := frameBuf[:n]
 		h.logDebug("收到帧: %d 字节", len(frame))
 
+		if limiter != nil {
+			throttled, err := limiter.wait(ctx)
+			if throttled {
+				h.framesThrottled.Add(1)
+			}
+			if err != nil {
+				return
+			}
+		}
+
 		// 解密
 		plaintext, err := h.crypto.Decrypt(frame)
 		if err != nil {
+			h.decryptFailed.Add(1)
+			if errors.Is(err, crypto.ErrKey) {
+				// 本地故障，与探测无关
+				keyStreak++
+				h.cryptoFailed("解密", keyStreak, conn, err)
+				continue
+			}
 			h.logDebug("解密失败: %v", err)
+			if !authenticated && h.probeDecoy != DecoyNone {
+				if probeFailures++; probeFailures >= probeDecoyThreshold {
+					h.decoy(conn)
+					return
+				}
+			}
 			// 静默丢弃无效数据，不断开连接
 			continue
 		}
+		keyStreak = 0
+		if !authenticated {
+			authenticated = true
+			if h.probeDecoy != DecoyNone {
+				reader.SetTimeout(transport.ReadTimeout)
+			}
+		}
 
 		if len(plaintext) < 1 {
 			continue
@@ -97,91 +525,118 @@ func (h *TCPHandler) HandleConnection(ctx context.Context, conn net.Conn) {
 			}
 		case protocol.TypeData:
 			h.handleData(plaintext)
+		case protocol.TypeData | protocol.FlagCompressed:
+			h.handleCompressedData(plaintext)
 		case protocol.TypeDisconnect:
 			h.handleDisconnect(plaintext)
+		case protocol.TypeWindowUpdate:
+			h.handleWindowUpdate(plaintext)
+		case protocol.TypeTrafficHint:
+			h.handleTrafficHint(plaintext, conn)
+		case protocol.TypeResolve:
+			resolve := func(msg []byte) {
+				if response := h.handleResolve(ctx, msg, conn); response != nil {
+					if err := writer.WriteFrame(response); err != nil {
+						h.logDebug("发送解析结果失败: %v", err)
+					}
+				}
+			}
+			// 查询可能较慢，不阻塞后续帧的处理；同时进行的查询达到上限后改为就地查询，
+			// 暂停读取该客户端的后续帧，防止单个客户端堆积大量查询
+			select {
+			case resolving <- struct{}{}:
+				go func(msg []byte) {
+					defer func() { <-resolving }()
+					resolve(msg)
+				}(plaintext)
+			default:
+				resolve(plaintext)
+			}
 		default:
+			h.unknownFrames.Add(1)
 			h.logDebug("未知消息类型: 0x%02x", msgType)
+			if unknownFrames++; h.unknownLimit > 0 && unknownFrames >= h.unknownLimit {
+				h.logInfo("收到 %d 个未知类型的帧 (最近为 0x%02x)，客户端协议可能不兼容，关闭连接: %s",
+					unknownFrames, msgType, conn.RemoteAddr())
+				return
+			}
 		}
 	}
 }
 
 func (h *TCPHandler) handleConnect(data []byte, clientConn net.Conn, writer *transport.FrameWriter) []byte {
-	if len(data) < 7 {
+	// 只要能取到 ReqID 就交给 ParseRequest 做完整校验，
+	// 格式错误统一回复 StatusError，避免不同长度的畸形消息得到不同待遇
+	if len(data) < 5 {
 		h.logDebug("Connect 数据太短: %d", len(data))
 		return nil
 	}
 
-	reqID := uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
-	network := data[5]
-	addrType := data[6]
-
-	var targetAddr string
-	var port uint16
-	offset := 7
-
-	switch addrType {
-	case protocol.AddrIPv4:
-		if len(data) < offset+6 {
-			return nil
-		}
-		ip := net.IP(data[offset : offset+4])
-		port = uint16(data[offset+4])<<8 | uint16(data[offset+5])
-		targetAddr = fmt.Sprintf("%s:%d", ip.String(), port)
-		offset += 6 // ← 修复：更新 offset
-
-	case protocol.AddrIPv6:
-		if len(data) < offset+18 {
-			return nil
-		}
-		ip := net.IP(data[offset : offset+16])
-		port = uint16(data[offset+16])<<8 | uint16(data[offset+17])
-		targetAddr = fmt.Sprintf("[%s]:%d", ip.String(), port)
-		offset += 18 // ← 修复：更新 offset
-
-	case protocol.AddrDomain:
-		if len(data) < offset+1 {
-			return nil
-		}
-		domainLen := int(data[offset])
-		if len(data) < offset+1+domainLen+2 {
-			return nil
-		}
-		domain := string(data[offset+1 : offset+1+domainLen])
-		port = uint16(data[offset+1+domainLen])<<8 | uint16(data[offset+1+domainLen+1])
-		targetAddr = fmt.Sprintf("%s:%d", domain, port)
-		offset += 1 + domainLen + 2 // ← 修复：更新 offset
-
-	default:
-		h.logDebug("未知地址类型: 0x%02x", addrType)
-		return h.buildConnectResponse(reqID, protocol.StatusError)
+	reqID := binary.BigEndian.Uint32(data[1:5])
+	req, err := protocol.ParseRequest(data)
+	if err != nil {
+		h.logDebug("解析 Connect 失败: %v", err)
+		return h.buildConnectResponse(clientConn, reqID, protocol.StatusError)
 	}
+	network := req.Network
+	targetAddr := req.TargetAddr()
 
-	// ← 新增：提取 InitData
-	var initData []byte
-	if len(data) > offset {
-		initData = data[offset:]
+	// 提取 InitData
+	initData := req.Data
+	if len(initData) > 0 {
 		h.logDebug("提取 InitData: %d 字节", len(initData))
 	}
 
 	// 确定网络类型
-	var networkStr string
-	switch network {
-	case protocol.NetworkTCP:
-		networkStr = "tcp"
-	case protocol.NetworkUDP:
-		networkStr = "udp"
-	default:
+	networkStr := req.NetworkString()
+	if networkStr == "unknown" {
 		h.logDebug("未知网络类型: 0x%02x", network)
-		return h.buildConnectResponse(reqID, protocol.StatusError)
+		return h.buildConnectResponse(clientConn, reqID, protocol.StatusError)
+	}
+	if h.allowedNetworks != nil && !h.allowedNetworks[network] {
+		h.logDebug("不允许代理 %s: ID=%d", networkStr, reqID)
+		return h.buildConnectResponse(clientConn, reqID, protocol.StatusNotAllowed)
+	}
+
+	upstream := h.upstream
+	if h.router != nil {
+		if e, ok := h.router.route(req.Address); ok {
+			if e.reject {
+				h.logDebug("路由规则拒绝: ID=%d -> %s", reqID, targetAddr)
+				return h.buildConnectResponse(clientConn, reqID, protocol.StatusNotAllowed)
+			}
+			upstream = e.upstream
+		}
 	}
 
 	h.logDebug("连接请求: ID=%d, %s -> %s", reqID, networkStr, targetAddr)
 
+	// 先占用名额，超出上限时让客户端退避重试
+	if !h.reserveConn() {
+		h.logDebug("连接数或内存预算已达上限，拒绝: ID=%d", reqID)
+		return h.buildConnectResponse(clientConn, reqID, protocol.StatusBusy,
+			binary.BigEndian.AppendUint16(nil, uint16(BusyRetryAfter/time.Second))...)
+	}
+
 	// 建立到目标的连接
-	targetConn, err := net.DialTimeout(networkStr, targetAddr, 10*time.Second)
+	timeout := h.connectTimeout(req)
+	dialer := net.Dialer{Timeout: timeout, Resolver: h.resolver}
+	if len(h.selfAddrs) > 0 {
+		dialer.Control = h.dialControl
+	}
+	var targetConn net.Conn
+	if upstream != nil && network == protocol.NetworkTCP {
+		targetConn, err = upstream.dial(&dialer, targetAddr, timeout)
+	} else if h.udpPortFirst > 0 && network == protocol.NetworkUDP {
+		targetConn, err = h.dialUDPMapped(dialer, targetAddr, reqID)
+	} else {
+		targetConn, err = dialer.Dial(networkStr, targetAddr)
+	}
 	if err != nil {
+		h.releaseConn()
+		h.connectFailed.Add(1)
 		h.logDebug("连接目标失败 %s: %v", targetAddr, err)
-		return h.buildConnectResponse(reqID, protocol.StatusConnectFailed)
+		return h.buildConnectResponse(clientConn, reqID, dialStatus(err))
 	}
 
 	// ← 新增：如果有 InitData，立即发送给目标
@@ -189,9 +644,12 @@ func (h *TCPHandler) handleConnect(data []byte, clientConn net.Conn, writer *tra
 		n, err := targetConn.Write(initData)
 		if err != nil {
 			h.logDebug("发送 InitData 失败: %v", err)
+			h.releaseConn()
+			h.connectFailed.Add(1)
 			targetConn.Close()
-			return h.buildConnectResponse(reqID, protocol.StatusConnectFailed)
+			return h.buildConnectResponse(clientConn, reqID, protocol.StatusConnectFailed)
 		}
+		h.bytesToTarget.Add(int64(n))
 		h.logDebug("发送 InitData 到目标: %d 字节", n)
 	}
 
@@ -200,16 +658,28 @@ func (h *TCPHandler) handleConnect(data []byte, clientConn net.Conn, writer *tra
 		Target:     targetConn,
 		ClientConn: clientConn,
 		Writer:     writer,
+		TargetAddr: targetAddr,
+		CreatedAt:  time.Now(),
 		LastActive: time.Now(),
 		Network:    network,
+		credit:     h.flowWindow,
+		creditCh:   make(chan struct{}, 1),
+	}
+	c.bytesUp.Store(int64(len(initData)))
+	if v, loaded := h.conns.Swap(reqID, c); loaded {
+		// 客户端复用了 ID，旧连接直接关闭，释放旧连接的名额
+		h.releaseConn()
+		old := v.(*Conn)
+		old.close()
+		h.logAccess(old, reasonReplaced)
 	}
-	h.conns.Store(reqID, c)
+	h.totalConns.Add(1)
 
 	// 启动从目标读取数据的协程
 	go h.readFromTarget(c)
 
 	h.logDebug("连接建立成功: ID=%d -> %s", reqID, targetAddr)
-	return h.buildConnectResponse(reqID, protocol.StatusOK)
+	return h.buildConnectResponse(clientConn, reqID, protocol.StatusOK)
 }
 
 func (h *TCPHandler) handleData(data []byte) {
@@ -237,11 +707,30 @@ func (h *TCPHandler) handleData(data []byte) {
 		if err != nil {
 			h.logDebug("写入目标失败: %v", err)
 		} else {
+			h.bytesToTarget.Add(int64(n))
+			c.bytesUp.Add(int64(n))
 			h.logDebug("发送到目标: %d 字节", n)
 		}
 	}
 }
 
+func (h *TCPHandler) handleCompressedData(data []byte) {
+	if !h.compression || len(data) < 5 {
+		h.logDebug("未开启压缩，丢弃压缩数据帧")
+		return
+	}
+
+	payload, err := decompressPayload(data[5:])
+	if err != nil {
+		h.logDebug("%v", err)
+		return
+	}
+	msg := make([]byte, 0, 5+len(payload))
+	msg = append(msg, protocol.TypeData)
+	msg = append(msg, data[1:5]...)
+	h.handleData(append(msg, payload...))
+}
+
 func (h *TCPHandler) handleDisconnect(data []byte) {
 	if len(data) < 5 {
 		return
@@ -249,19 +738,180 @@ func (h *TCPHandler) handleDisconnect(data []byte) {
 
 	connID := uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
 
-	if v, ok := h.conns.LoadAndDelete(connID); ok {
-		c := v.(*Conn)
-		c.mu.Lock()
-		c.closed = true
-		if c.Target != nil {
-			c.Target.Close()
-		}
-		c.mu.Unlock()
+	if v, ok := h.conns.Load(connID); ok && h.removeConn(v.(*Conn), reasonClientClose) {
+		v.(*Conn).close()
 		h.logDebug("连接关闭: %d", connID)
 	}
 }
 
-func (h *TCPHandler) buildConnectResponse(reqID uint32, status byte) []byte {
+// handleWindowUpdate 为连接追加流控额度
+func (h *TCPHandler) handleWindowUpdate(data []byte) {
+	req, err := protocol.ParseRequest(data)
+	if err != nil {
+		h.logDebug("解析 WindowUpdate 失败: %v", err)
+		return
+	}
+	v, ok := h.conns.Load(req.ReqID)
+	if !ok {
+		return
+	}
+
+	c := v.(*Conn)
+	delta := int64(binary.BigEndian.Uint32(req.Data))
+	c.mu.Lock()
+	c.credit += delta
+	c.mu.Unlock()
+	c.wake()
+	h.logDebug("追加流控额度: %d 字节 (ID=%d)", delta, c.ID)
+}
+
+// handleTrafficHint 按客户端声明的流量类型切换客户端连接的 TCP_NODELAY
+func (h *TCPHandler) handleTrafficHint(data []byte, conn net.Conn) {
+	req, err := protocol.ParseRequest(data)
+	if err != nil {
+		h.logDebug("解析 TrafficHint 失败: %v", err)
+		return
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	switch req.Data[0] {
+	case protocol.TrafficInteractive:
+		_ = tcpConn.SetNoDelay(true)
+	case protocol.TrafficBulk:
+		_ = tcpConn.SetNoDelay(false)
+	default:
+		h.logDebug("未知流量类型: 0x%02x", req.Data[0])
+		return
+	}
+	h.logDebug("切换流量类型: 0x%02x [%s]", req.Data[0], conn.RemoteAddr())
+}
+
+// dialUDPMapped 从源端口范围中为连接选取本地端口并连接 UDP 目标
+func (h *TCPHandler) dialUDPMapped(dialer net.Dialer, targetAddr string, reqID uint32) (net.Conn, error) {
+	span := h.udpPortLast - h.udpPortFirst + 1
+	start := int(reqID % uint32(span))
+	for i := 0; i < span; i++ {
+		port := h.udpPortFirst + (start+i)%span
+		dialer.LocalAddr = &net.UDPAddr{Port: port}
+		conn, err := dialer.Dial("udp", targetAddr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		if err == nil {
+			h.logDebug("UDP 源端口映射: ID=%d -> %s", reqID, conn.LocalAddr())
+		}
+		return conn, err
+	}
+	return nil, fmt.Errorf("UDP 源端口 %d-%d 已全部占用", h.udpPortFirst, h.udpPortLast)
+}
+
+// connectTimeout 返回本次 Connect 使用的连接超时
+// 客户端未指定时使用默认值，指定的值不超过 maxDialTimeout
+func (h *TCPHandler) connectTimeout(req *protocol.Request) time.Duration {
+	if req.ConnectTimeout <= 0 {
+		return h.dialTimeout
+	}
+	return min(req.ConnectTimeout, h.maxDialTimeout)
+}
+
+// dialStatus 将拨号错误映射为具体的状态码，便于客户端区分失败原因
+func dialStatus(err error) byte {
+	if errors.Is(err, errLoopDetected) {
+		return protocol.StatusLoopDetected
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		switch upErr.status {
+		case http.StatusForbidden:
+			return protocol.StatusNotAllowed
+		case http.StatusGatewayTimeout:
+			return protocol.StatusTimeout
+		default:
+			return protocol.StatusConnectFailed
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return protocol.StatusDNSFailed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return protocol.StatusConnRefused
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return protocol.StatusTimeout
+	}
+	return protocol.StatusConnectFailed
+}
+
+// reserveConn 占用一个代理连接名额及其内存预算，失败时不占用任何资源
+func (h *TCPHandler) reserveConn() bool {
+	if n := h.activeConns.Add(1); h.maxConns > 0 && n > int64(h.maxConns) {
+		h.activeConns.Add(-1)
+		return false
+	}
+	if !h.reserveMemory(connMemCost) {
+		h.activeConns.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (h *TCPHandler) releaseConn() {
+	h.activeConns.Add(-1)
+	h.releaseMemory(connMemCost)
+}
+
+func (h *TCPHandler) reserveMemory(n int64) bool {
+	if used := h.memoryReserved.Add(n); h.memoryBudget > 0 && used > h.memoryBudget {
+		h.memoryReserved.Add(-n)
+		return false
+	}
+	return true
+}
+
+func (h *TCPHandler) releaseMemory(n int64) {
+	h.memoryReserved.Add(-n)
+}
+
+// removeConn 从连接表中移除连接，返回是否由本次调用移除
+// 每个连接只会成功移除一次，访问日志和发给客户端的关闭通知也在这里输出
+// 关闭通知异步发送，客户端停止读取时不会阻塞清理循环或管理命令
+func (h *TCPHandler) removeConn(c *Conn, reason string) bool {
+	if h.conns.CompareAndDelete(c.ID, c) {
+		h.releaseConn()
+		h.logAccess(c, reason)
+		if code, ok := closeReasonCodes[reason]; ok {
+			go h.sendDisconnect(c, code)
+		}
+		return true
+	}
+	return false
+}
+
+// logAccess 输出一行连接汇总
+func (h *TCPHandler) logAccess(c *Conn, reason string) {
+	if !h.accessLog {
+		return
+	}
+	if level, _ := h.logLevel.Load().(string); level == "error" {
+		return
+	}
+
+	client := "-"
+	if c.ClientConn != nil {
+		client = c.ClientConn.RemoteAddr().String()
+	}
+	log.Printf("[ACCESS] id=%d client=%s target=%s network=%s duration=%s up=%d down=%d reason=%s",
+		c.ID, client, c.TargetAddr, networkName(c.Network),
+		time.Since(c.CreatedAt).Round(time.Millisecond),
+		c.bytesUp.Load(), c.bytesDown.Load(), reason)
+}
+
+func (h *TCPHandler) buildConnectResponse(clientConn net.Conn, reqID uint32, status byte, data ...byte) []byte {
 	resp := []byte{
 		protocol.TypeConnectResp,
 		byte(reqID >> 24),
@@ -270,8 +920,9 @@ func (h *TCPHandler) buildConnectResponse(reqID uint32, status byte) []byte {
 		byte(reqID),
 		status,
 	}
+	resp = append(resp, data...)
 
-	encrypted, err := h.crypto.Encrypt(resp)
+	encrypted, err := h.encrypt(resp, clientConn)
 	if err != nil {
 		h.logDebug("加密响应失败: %v", err)
 		return nil
@@ -279,11 +930,48 @@ func (h *TCPHandler) buildConnectResponse(reqID uint32, status byte) []byte {
 	return encrypted
 }
 
+// encrypt 加密发往 conn 的消息，并按加密失败策略处理错误
+// 连续失败按客户端连接分别计数，只关闭失败累计到阈值的那个连接
+func (h *TCPHandler) encrypt(msg []byte, conn net.Conn) ([]byte, error) {
+	var cl *client
+	if v, ok := h.clients.Load(conn); ok {
+		cl = v.(*client)
+	}
+	encrypted, err := h.crypto.Encrypt(msg)
+	if err == nil {
+		if cl != nil {
+			cl.encryptStreak.Store(0)
+		}
+		return encrypted, nil
+	}
+
+	h.encryptFailed.Add(1)
+	n := int64(1) // 未登记的连接 (如已断开的客户端) 不累计
+	if cl != nil {
+		n = cl.encryptStreak.Add(1)
+	}
+	h.cryptoFailed("加密", n, conn, err)
+	return nil, err
+}
+
+// cryptoFailed 按加密失败策略处理第 n 次连续的本地加解密故障
+func (h *TCPHandler) cryptoFailed(op string, n int64, conn net.Conn, err error) {
+	if n == 1 && (errors.Is(err, crypto.ErrRandom) || errors.Is(err, crypto.ErrKey)) {
+		// 只在连续失败的开始输出，避免故障期间刷屏
+		log.Printf("[ERROR] %s失败，丢弃消息: %v", op, err)
+	}
+	if h.cryptoFailFast && n >= CryptoFailFastThreshold && conn != nil {
+		log.Printf("[ERROR] 连续 %d 次%s失败，关闭客户端连接 %s: %v", n, op, conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
 func (h *TCPHandler) readFromTarget(c *Conn) {
-	buf := make([]byte, 32*1024) // 32KB 缓冲
+	buf := make([]byte, targetReadBufSize)
+	reason := reasonTargetClose
 
 	defer func() {
-		h.conns.Delete(c.ID)
+		h.removeConn(c, reason)
 		c.mu.Lock()
 		if c.Target != nil {
 			c.Target.Close()
@@ -299,40 +987,72 @@ func (h *TCPHandler) readFromTarget(c *Conn) {
 			return
 		}
 		target := c.Target
+		readBuf := buf
+		if h.flowWindow > 0 {
+			if c.credit <= 0 {
+				// 额度用完，等待客户端追加或连接关闭
+				c.mu.Unlock()
+				<-c.creditCh
+				continue
+			}
+			if c.credit < int64(len(readBuf)) {
+				readBuf = readBuf[:c.credit]
+			}
+		}
 		c.mu.Unlock()
 
-		n, err := target.Read(buf)
+		n, err := target.Read(readBuf)
 		if err != nil {
 			if err != io.EOF {
 				h.logDebug("读取目标失败: %v", err)
+				reason = reasonTargetError
 			}
 			return
 		}
 
 		c.mu.Lock()
 		c.LastActive = time.Now()
+		c.credit -= int64(n)
 		c.mu.Unlock()
+		h.bytesFromTarget.Add(int64(n))
+		c.bytesDown.Add(int64(n))
 
 		h.logDebug("从目标收到: %d 字节 (ID=%d)", n, c.ID)
 
 		// 构建数据包
-		packet := make([]byte, 5+n)
-		packet[0] = protocol.TypeData
+		msgType := byte(protocol.TypeData)
+		payload := buf[:n]
+		if h.compression {
+			if compressed, ok := compressPayload(payload); ok {
+				msgType |= protocol.FlagCompressed
+				payload = compressed
+			}
+		}
+
+		packet := make([]byte, 5+len(payload))
+		packet[0] = msgType
 		packet[1] = byte(c.ID >> 24)
 		packet[2] = byte(c.ID >> 16)
 		packet[3] = byte(c.ID >> 8)
 		packet[4] = byte(c.ID)
-		copy(packet[5:], buf[:n])
+		copy(packet[5:], payload)
 
-		encrypted, err := h.crypto.Encrypt(packet)
+		encrypted, err := h.encrypt(packet, c.ClientConn)
 		if err != nil {
 			h.logDebug("加密数据失败: %v", err)
 			continue
 		}
 
 		// 发送加密数据到客户端
-		if err := c.Writer.WriteFrame(encrypted); err != nil {
+		if err := c.Writer.WriteFrameFor(c.ID, encrypted); err != nil {
 			h.logDebug("发送数据到客户端失败: %v", err)
+			reason = reasonClientWrite
+			// 超时可能只写出了半帧，客户端连接上的帧边界已被破坏，
+			// 且客户端已停止读取，直接关闭整个客户端连接
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && c.ClientConn != nil {
+				c.ClientConn.Close()
+			}
 			return
 		}
 		h.logDebug("发送到客户端: %d 字节 (ID=%d)", len(encrypted), c.ID)
@@ -340,11 +1060,16 @@ func (h *TCPHandler) readFromTarget(c *Conn) {
 }
 
 func (h *TCPHandler) cleanupLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(h.cleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		h.cleanup()
+	for {
+		select {
+		case <-ticker.C:
+			h.cleanup()
+		case <-h.done:
+			return
+		}
 	}
 }
 
@@ -354,39 +1079,143 @@ func (h *TCPHandler) cleanup() {
 		c := value.(*Conn)
 		c.mu.Lock()
 		lastActive := c.LastActive
+		createdAt := c.CreatedAt
 		c.mu.Unlock()
 
+		// 先摘除再关闭：关闭目标会唤醒 readFromTarget，摘除在前才能记录正确的关闭原因
 		if now.Sub(lastActive) > 5*time.Minute {
-			c.mu.Lock()
-			c.closed = true
-			if c.Target != nil {
-				c.Target.Close()
+			if h.removeConn(c, reasonIdleTimeout) {
+				c.close()
+				h.logDebug("清理超时连接: %d", c.ID)
+			}
+		} else if h.maxConnLifetime > 0 && now.Sub(createdAt) > h.maxConnLifetime {
+			if h.removeConn(c, reasonMaxLifetime) {
+				c.close()
+				h.logDebug("连接超过最长存活时间: %d", c.ID)
 			}
-			c.mu.Unlock()
-			h.conns.Delete(key)
-			h.logDebug("清理超时连接: %d", c.ID)
 		}
 		return true
 	})
 }
 
-func (h *TCPHandler) logDebug(format string, args ...interface{}) {
-	if h.logLevel == "debug" {
-		log.Printf("[DEBUG] "+format, args...)
+// sendDisconnect 通知客户端连接已被服务端关闭，并附上关闭原因
+func (h *TCPHandler) sendDisconnect(c *Conn, reason byte) {
+	if c.Writer == nil {
+		return
+	}
+	encrypted, err := h.encrypt(protocol.BuildCloseReason(c.ID, reason), c.ClientConn)
+	if err != nil {
+		h.logDebug("加密断开通知失败: %v", err)
+		return
+	}
+	if err := c.Writer.WriteFrameFor(c.ID, encrypted); err != nil {
+		h.logDebug("发送断开通知失败: %v", err)
 	}
 }
 
-// Close 关闭所有连接
-func (h *TCPHandler) Close() {
-	h.conns.Range(func(key, value interface{}) bool {
+// Conns 返回当前活跃连接的快照，按 ID 排序
+func (h *TCPHandler) Conns() []ConnInfo {
+	var infos []ConnInfo
+	h.conns.Range(func(_, value interface{}) bool {
 		c := value.(*Conn)
 		c.mu.Lock()
-		c.closed = true
+		info := ConnInfo{
+			ID:         c.ID,
+			Network:    networkName(c.Network),
+			Target:     c.TargetAddr,
+			LastActive: c.LastActive,
+		}
+		if c.ClientConn != nil {
+			info.Client = c.ClientConn.RemoteAddr().String()
+		}
 		if c.Target != nil {
-			c.Target.Close()
+			info.Local = c.Target.LocalAddr().String()
 		}
 		c.mu.Unlock()
-		h.conns.Delete(key)
+		infos = append(infos, info)
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConn 按 ID 强制关闭连接，连接不存在时返回 false
+func (h *TCPHandler) CloseConn(id uint32) bool {
+	v, ok := h.conns.Load(id)
+	if !ok || !h.removeConn(v.(*Conn), reasonAdminClose) {
+		return false
+	}
+	v.(*Conn).close()
+	h.logDebug("强制关闭连接: %d", id)
+	return true
+}
+
+// Stats 返回统计信息
+func (h *TCPHandler) Stats() Stats {
+	return Stats{
+		ActiveConns:     h.activeConns.Load(),
+		TotalConns:      h.totalConns.Load(),
+		ConnectFailed:   h.connectFailed.Load(),
+		DecryptFailed:   h.decryptFailed.Load(),
+		EncryptFailed:   h.encryptFailed.Load(),
+		BytesToTarget:   h.bytesToTarget.Load(),
+		BytesFromTarget: h.bytesFromTarget.Load(),
+		MemoryReserved:  h.memoryReserved.Load(),
+		FramesThrottled: h.framesThrottled.Load(),
+		UnknownFrames:   h.unknownFrames.Load(),
+		Windows:         h.crypto.WindowStats(),
+		NonceCache:      h.crypto.CacheStats(),
+	}
+}
+
+func networkName(network byte) string {
+	switch network {
+	case protocol.NetworkTCP:
+		return "tcp"
+	case protocol.NetworkUDP:
+		return "udp"
+	default:
+		return "unknown"
+	}
+}
+
+func (h *TCPHandler) logInfo(format string, args ...interface{}) {
+	if level, _ := h.logLevel.Load().(string); level != "error" {
+		log.Printf("[INFO] "+format, args...)
+	}
+}
+
+func (h *TCPHandler) logDebug(format string, args ...interface{}) {
+	if level, _ := h.logLevel.Load().(string); level == "debug" {
+		log.Printf("[DEBUG] "+format, args...)
+	}
+}
+
+// NotifyShutdown 实现 transport.ShutdownNotifier，向每个客户端发送关闭通知
+func (h *TCPHandler) NotifyShutdown() {
+	msg := []byte{protocol.TypeServerShutdown, 0, 0, 0, 0}
+	h.clients.Range(func(key, value interface{}) bool {
+		writer := value.(*client).writer
+		// 每帧单独加密，避免不同连接出现相同的 nonce
+		encrypted, err := h.encrypt(msg, key.(net.Conn))
+		if err != nil {
+			h.logDebug("加密关闭通知失败: %v", err)
+			return true
+		}
+		if err := writer.WriteFrame(encrypted); err != nil {
+			h.logDebug("发送关闭通知失败: %v", err)
+		}
+		return true
+	})
+}
+
+// Close 关闭所有连接并停止后台清理，可重复调用
+func (h *TCPHandler) Close() {
+	h.doneOnce.Do(func() { close(h.done) })
+	h.conns.Range(func(key, value interface{}) bool {
+		if c := value.(*Conn); h.removeConn(c, reasonShutdown) {
+			c.close()
+		}
 		return true
 	})
 }
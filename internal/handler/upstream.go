@@ -0,0 +1,102 @@
+// internal/handler/upstream.go
+
+package handler
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Upstream 通过上游 HTTP 代理的 CONNECT 方法连接目标
+type Upstream struct {
+	addr string
+	auth string // Proxy-Authorization 头，空表示不认证
+}
+
+// upstreamError 上游代理拒绝了 CONNECT 请求
+type upstreamError struct {
+	status int
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("上游代理返回 %d %s", e.status, http.StatusText(e.status))
+}
+
+// ParseUpstream 解析上游代理地址，格式 http://[user:pass@]host:port
+func ParseUpstream(rawURL string) (*Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("上游代理地址无效: %w", err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("上游代理只支持 http://: %q", rawURL)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("上游代理缺少端口: %q", rawURL)
+	}
+
+	up := &Upstream{addr: u.Host}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := u.User.Username() + ":" + password
+		up.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	return up, nil
+}
+
+// dial 连接上游代理并建立到 target 的隧道，握手整体受 timeout 限制
+func (u *Upstream) dial(dialer *net.Dialer, target string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.auth != "" {
+		req.Header.Set("Proxy-Authorization", u.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &upstreamError{status: resp.StatusCode}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// 代理在响应后紧跟着发来了目标的数据
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读出握手时多读的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
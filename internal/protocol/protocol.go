@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
+	"time"
 )
 
 // 消息类型
@@ -14,8 +16,24 @@ const (
 	TypeClose       = 0x03
 	TypeDisconnect  = 0x03 // TypeClose 的别名
 	TypeConnectResp = 0x04 // 连接响应
+
+	TypeServerShutdown = 0x05 // 服务端即将关闭，客户端应主动断开并重连其他节点
+	TypeWindowUpdate   = 0x06 // 流控: 客户端为连接追加可接收的字节数，Data 为 4 字节增量
+	TypeTrafficHint    = 0x07 // 客户端声明整条 TCP 连接的流量类型，Data 为 1 字节 Traffic*
+	TypeResolve        = 0x08 // 客户端请求服务端解析域名，Address 为域名
+	TypeResolveResp    = 0x09 // 域名解析结果，格式同 TypeConnectResp，负载为地址列表
+)
+
+// 流量类型，用于 TypeTrafficHint
+const (
+	TrafficInteractive = 0x00 // 交互式，优先延迟 (开启 TCP_NODELAY)
+	TrafficBulk        = 0x01 // 大块传输，优先吞吐 (关闭 TCP_NODELAY)
 )
 
+// FlagCompressed 消息类型的最高位，置位表示 Data 负载经过 DEFLATE 压缩
+// 目前只用于 TypeData
+const FlagCompressed = 0x80
+
 // 地址类型
 const (
 	AddrIPv4   = 0x01
@@ -29,11 +47,33 @@ const (
 	NetworkUDP = 0x02
 )
 
+// NetworkFlagTimeout Network 字节的最高位，置位表示其后跟 2 字节连接超时 (毫秒)
+const NetworkFlagTimeout = 0x80
+
+// MaxConnectTimeout Connect 中可携带的最大连接超时
+const MaxConnectTimeout = 65535 * time.Millisecond
+
 // 状态码
 const (
 	StatusOK            = 0x00 // 成功
 	StatusError         = 0x01 // 通用错误
 	StatusConnectFailed = 0x02 // 连接失败
+	StatusBusy          = 0x03 // 资源不足，Data 为建议的重试等待秒数 (2 字节)
+	StatusDNSFailed     = 0x04 // 目标域名解析失败
+	StatusConnRefused   = 0x05 // 目标拒绝连接
+	StatusTimeout       = 0x06 // 连接目标超时
+	StatusNotAllowed    = 0x07 // 服务端不允许代理该网络类型
+	StatusLoopDetected  = 0x08 // 目标指向服务端自身，拒绝形成代理环路
+)
+
+// 关闭原因，服务端关闭代理连接时附在 TypeClose 之后，便于客户端决定是否重试
+const (
+	CloseReasonNone         = 0x00 // 未说明原因 (客户端发出的关闭或旧版本服务端)
+	CloseReasonTargetClosed = 0x01 // 目标正常关闭了连接
+	CloseReasonTargetError  = 0x02 // 读取目标出错 (如连接被重置)
+	CloseReasonIdleTimeout  = 0x03 // 连接空闲超时被回收
+	CloseReasonMaxLifetime  = 0x04 // 超过最长存活时间
+	CloseReasonAdminClose   = 0x05 // 被管理接口强制关闭
 )
 
 // Request 解析后的请求
@@ -44,10 +84,13 @@ type Request struct {
 	Address string
 	Port    uint16
 	Data    []byte
+
+	// ConnectTimeout 客户端为本次连接指定的超时，0 表示使用服务端默认值
+	ConnectTimeout time.Duration
 }
 
 // ParseRequest 解析请求
-// 格式: Type(1) + ReqID(4) + [Network(1) + AddrType(1) + Addr + Port(2)] + [Data]
+// 格式: Type(1) + ReqID(4) + [Network(1) + [Timeout(2)] + AddrType(1) + Addr + Port(2)] + [Data]
 func ParseRequest(data []byte) (*Request, error) {
 	if len(data) < 5 {
 		return nil, fmt.Errorf("数据太短: %d", len(data))
@@ -68,8 +111,28 @@ func ParseRequest(data []byte) (*Request, error) {
 		}
 		return req, nil
 	case TypeClose:
+		if len(data) > 5 {
+			req.Data = data[5:]
+		}
+		return req, nil
+	case TypeServerShutdown:
 		return req, nil
-	case TypeConnectResp:
+	case TypeWindowUpdate:
+		if len(data) < 9 {
+			return nil, fmt.Errorf("WindowUpdate 数据不足: %d", len(data))
+		}
+		// 多余的字节留给以后的扩展，Data 与其他类型一样延伸到消息末尾
+		req.Data = data[5:]
+		return req, nil
+	case TypeTrafficHint:
+		if len(data) < 6 {
+			return nil, fmt.Errorf("TrafficHint 数据不足")
+		}
+		req.Data = data[5:]
+		return req, nil
+	case TypeResolve:
+		return parseResolve(req, data[5:])
+	case TypeConnectResp, TypeResolveResp:
 		if len(data) > 5 {
 			req.Data = data[5:]
 		}
@@ -85,8 +148,17 @@ func parseConnect(req *Request, data []byte) (*Request, error) {
 	}
 
 	req.Network = data[0]
-	addrType := data[1]
-	offset := 2
+	offset := 1
+	if req.Network&NetworkFlagTimeout != 0 {
+		if len(data) < offset+2+3 {
+			return nil, fmt.Errorf("连接超时数据不足")
+		}
+		req.Network &^= NetworkFlagTimeout
+		req.ConnectTimeout = time.Duration(binary.BigEndian.Uint16(data[offset:offset+2])) * time.Millisecond
+		offset += 2
+	}
+	addrType := data[offset]
+	offset++
 
 	switch addrType {
 	case AddrIPv4:
@@ -109,10 +181,17 @@ func parseConnect(req *Request, data []byte) (*Request, error) {
 		}
 		dlen := int(data[offset])
 		offset++
+		if dlen == 0 {
+			return nil, fmt.Errorf("域名为空")
+		}
 		if len(data) < offset+dlen+2 {
 			return nil, fmt.Errorf("域名数据不足")
 		}
 		req.Address = string(data[offset : offset+dlen])
+		// 域名字段里的 IP 字面量统一成规范形式，与 IPv4/IPv6 类型的结果保持一致
+		if ip := net.ParseIP(req.Address); ip != nil {
+			req.Address = ip.String()
+		}
 		offset += dlen
 
 	default:
@@ -130,12 +209,79 @@ func parseConnect(req *Request, data []byte) (*Request, error) {
 	return req, nil
 }
 
+// parseResolve 解析 Resolve 请求，域名之后的字节留作扩展，放在 Data 中
+func parseResolve(req *Request, data []byte) (*Request, error) {
+	if len(data) < 1 || data[0] == 0 {
+		return nil, fmt.Errorf("域名为空")
+	}
+	dlen := int(data[0])
+	if len(data) < 1+dlen {
+		return nil, fmt.Errorf("域名数据不足")
+	}
+	req.Address = string(data[1 : 1+dlen])
+	if len(data) > 1+dlen {
+		req.Data = data[1+dlen:]
+	}
+	return req, nil
+}
+
+// BuildBatch 将多条消息合并到一个缓冲中
+// 格式: [Len(2) + Message]...
+// 消息本身不带长度（Data 的负载一直延伸到末尾），因此批量时需要逐条加长度前缀
+func BuildBatch(msgs ...[]byte) []byte {
+	size := 0
+	for _, msg := range msgs {
+		size += 2 + len(msg)
+	}
+	buf := make([]byte, 0, size)
+	for _, msg := range msgs {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg)))
+		buf = append(buf, msg...)
+	}
+	return buf
+}
+
+// ParseRequests 依次解析 BuildBatch 格式的缓冲
+// 遇到截断或无法解析的消息时，返回已解析的请求和描述剩余字节的错误
+func ParseRequests(data []byte) ([]*Request, error) {
+	var reqs []*Request
+	offset := 0
+
+	for offset < len(data) {
+		if len(data)-offset < 2 {
+			return reqs, fmt.Errorf("末尾有 %d 字节无法解析", len(data)-offset)
+		}
+		msgLen := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+		if len(data)-offset-2 < msgLen {
+			return reqs, fmt.Errorf("末尾消息被截断: 需要 %d 字节，剩余 %d 字节", msgLen, len(data)-offset-2)
+		}
+
+		req, err := ParseRequest(data[offset+2 : offset+2+msgLen])
+		if err != nil {
+			return reqs, fmt.Errorf("偏移 %d 处的消息无效: %w", offset, err)
+		}
+		reqs = append(reqs, req)
+		offset += 2 + msgLen
+	}
+
+	return reqs, nil
+}
+
+// CloseReason 返回 TypeClose 携带的关闭原因，没有携带时返回 CloseReasonNone
+func (r *Request) CloseReason() byte {
+	if r.Type != TypeClose || len(r.Data) == 0 {
+		return CloseReasonNone
+	}
+	return r.Data[0]
+}
+
 // TargetAddr 返回目标地址
 func (r *Request) TargetAddr() string {
 	if r.Address == "" {
 		return ""
 	}
-	return fmt.Sprintf("%s:%d", r.Address, r.Port)
+	// JoinHostPort 会为 IPv6（含 zone）加上方括号
+	return net.JoinHostPort(r.Address, strconv.Itoa(int(r.Port)))
 }
 
 // NetworkString 返回网络类型字符串
@@ -150,6 +296,158 @@ func (r *Request) NetworkString() string {
 	}
 }
 
+// ParseNetwork 将 "tcp"/"udp" 转换为网络类型
+func ParseNetwork(name string) (byte, error) {
+	switch name {
+	case "tcp":
+		return NetworkTCP, nil
+	case "udp":
+		return NetworkUDP, nil
+	default:
+		return 0, fmt.Errorf("未知网络类型: %s", name)
+	}
+}
+
+// BuildConnect 构建 Connect 请求，host 可以是 IPv4、IPv6 或域名
+// 格式: Type(1) + ReqID(4) + Network(1) + AddrType(1) + Addr + Port(2) + [InitData]
+func BuildConnect(reqID uint32, network byte, host string, port uint16, initData []byte) ([]byte, error) {
+	return BuildConnectTimeout(reqID, network, host, port, 0, initData)
+}
+
+// BuildConnectTimeout 构建携带连接超时的 Connect 请求，timeout 为 0 时与 BuildConnect 相同
+// 超时按毫秒编码，不能超过 MaxConnectTimeout
+// 格式: Type(1) + ReqID(4) + Network(1) + [Timeout(2)] + AddrType(1) + Addr + Port(2) + [InitData]
+func BuildConnectTimeout(reqID uint32, network byte, host string, port uint16, timeout time.Duration, initData []byte) ([]byte, error) {
+	if timeout < 0 || timeout > MaxConnectTimeout {
+		return nil, fmt.Errorf("连接超时超出范围: %v", timeout)
+	}
+
+	msg := make([]byte, 6, 6+2+1+1+len(host)+2+len(initData))
+	msg[0] = TypeConnect
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	msg[5] = network &^ NetworkFlagTimeout
+	if ms := timeout.Milliseconds(); ms > 0 {
+		msg[5] |= NetworkFlagTimeout
+		msg = binary.BigEndian.AppendUint16(msg, uint16(ms))
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = append(msg, AddrIPv4)
+			msg = append(msg, ip4...)
+		} else {
+			msg = append(msg, AddrIPv6)
+			msg = append(msg, ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("域名长度无效: %d", len(host))
+		}
+		msg = append(msg, AddrDomain)
+		msg = append(msg, byte(len(host)))
+		msg = append(msg, host...)
+	}
+
+	msg = binary.BigEndian.AppendUint16(msg, port)
+	return append(msg, initData...), nil
+}
+
+// BuildData 构建数据消息
+// 格式: Type(1) + ReqID(4) + Data
+func BuildData(reqID uint32, data []byte) []byte {
+	msg := make([]byte, 5+len(data))
+	msg[0] = TypeData
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	copy(msg[5:], data)
+	return msg
+}
+
+// BuildClose 构建关闭消息
+// 格式: Type(1) + ReqID(4)
+func BuildClose(reqID uint32) []byte {
+	msg := make([]byte, 5)
+	msg[0] = TypeClose
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	return msg
+}
+
+// BuildCloseReason 构建携带关闭原因的关闭消息，用于服务端通知客户端
+// 格式: Type(1) + ReqID(4) + Reason(1)
+func BuildCloseReason(reqID uint32, reason byte) []byte {
+	return append(BuildClose(reqID), reason)
+}
+
+// BuildWindowUpdate 构建流控额度更新
+// 格式: Type(1) + ReqID(4) + Delta(4)
+func BuildWindowUpdate(reqID uint32, delta uint32) []byte {
+	msg := make([]byte, 9)
+	msg[0] = TypeWindowUpdate
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	binary.BigEndian.PutUint32(msg[5:9], delta)
+	return msg
+}
+
+// BuildTrafficHint 构建流量类型声明，ReqID 不使用
+// 格式: Type(1) + ReqID(4) + Traffic(1)
+func BuildTrafficHint(traffic byte) []byte {
+	return []byte{TypeTrafficHint, 0, 0, 0, 0, traffic}
+}
+
+// BuildResolve 构建域名解析请求，客户端拿到地址后可以直接按 IP 发起 Connect
+// 格式: Type(1) + ReqID(4) + NameLen(1) + Name
+func BuildResolve(reqID uint32, name string) ([]byte, error) {
+	if len(name) == 0 || len(name) > 255 {
+		return nil, fmt.Errorf("域名长度无效: %d", len(name))
+	}
+	msg := make([]byte, 6, 6+len(name))
+	msg[0] = TypeResolve
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	msg[5] = byte(len(name))
+	return append(msg, name...), nil
+}
+
+// BuildResolveResp 构建域名解析结果
+// 格式: Type(1) + ReqID(4) + Status(1) + [AddrType(1) + Addr]...
+func BuildResolveResp(reqID uint32, status byte, ips []net.IP) []byte {
+	msg := make([]byte, 6, 6+len(ips)*17)
+	msg[0] = TypeResolveResp
+	binary.BigEndian.PutUint32(msg[1:5], reqID)
+	msg[5] = status
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = append(msg, AddrIPv4)
+			msg = append(msg, ip4...)
+		} else if ip16 := ip.To16(); ip16 != nil {
+			msg = append(msg, AddrIPv6)
+			msg = append(msg, ip16...)
+		}
+	}
+	return msg
+}
+
+// ParseResolveAddrs 解析 TypeResolveResp 负载中的地址列表 (ParseResponse 返回的 payload)
+func ParseResolveAddrs(payload []byte) ([]net.IP, error) {
+	var ips []net.IP
+	for offset := 0; offset < len(payload); {
+		size := 0
+		switch payload[offset] {
+		case AddrIPv4:
+			size = net.IPv4len
+		case AddrIPv6:
+			size = net.IPv6len
+		default:
+			return ips, fmt.Errorf("未知地址类型: %d", payload[offset])
+		}
+		offset++
+		if len(payload)-offset < size {
+			return ips, fmt.Errorf("地址数据不足")
+		}
+		ips = append(ips, net.IP(payload[offset:offset+size]))
+		offset += size
+	}
+	return ips, nil
+}
+
 // BuildResponse 构建响应
 // 格式: Type(1) + ReqID(4) + Status(1) + [Data]
 func BuildResponse(reqID uint32, status byte, data []byte) []byte {
@@ -163,6 +461,25 @@ func BuildResponse(reqID uint32, status byte, data []byte) []byte {
 	return resp
 }
 
+// ParseResponse 解析响应，与 BuildResponse 对应
+// 格式: Type(1) + ReqID(4) + Status(1) + [Data]
+// 服务端的连接响应 (TypeConnectResp) 与解析结果 (TypeResolveResp) 使用相同格式
+func ParseResponse(data []byte) (reqID uint32, status byte, payload []byte, err error) {
+	if len(data) < 6 {
+		return 0, 0, nil, fmt.Errorf("响应太短: %d", len(data))
+	}
+	if data[0] != TypeData && data[0] != TypeConnectResp && data[0] != TypeResolveResp {
+		return 0, 0, nil, fmt.Errorf("非响应类型: %d", data[0])
+	}
+
+	reqID = binary.BigEndian.Uint32(data[1:5])
+	status = data[5]
+	if len(data) > 6 {
+		payload = data[6:]
+	}
+	return reqID, status, payload, nil
+}
+
 // IsARQPacket 检查是否可能是 ARQ 包
 // ARQ 包格式: Seq(4) + Ack(4) + Flags(1) + Len(2) + Payload
 // 协议包格式: Type(1) + ReqID(4) + ...
@@ -171,7 +488,9 @@ func IsARQPacket(data []byte) bool {
 	if len(data) < 11 {
 		return false
 	}
-	// 如果第一个字节是协议类型（0x01, 0x02, 0x03, 0x04），则是协议包
+	// 如果第一个字节是协议类型（0x01 - 0x09），则是协议包
 	firstByte := data[0]
-	return firstByte != TypeConnect && firstByte != TypeData && firstByte != TypeClose && firstByte != TypeConnectResp
+	return firstByte != TypeConnect && firstByte != TypeData && firstByte != TypeClose && firstByte != TypeConnectResp &&
+		firstByte != TypeServerShutdown && firstByte != TypeWindowUpdate && firstByte != TypeTrafficHint &&
+		firstByte != TypeResolve && firstByte != TypeResolveResp
 }
@@ -1,8 +1,13 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
+	mathrand "math/rand"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConnectIPv4(t *testing.T) {
@@ -99,3 +104,312 @@ func TestBuildResponse(t *testing.T) {
 		t.Errorf("Data 错误: %s", resp[6:])
 	}
 }
+
+func TestParseResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		reqID   uint32
+		status  byte
+		payload []byte
+	}{
+		{"空数据", 1, StatusOK, nil},
+		{"带数据", 0xDEADBEEF, StatusConnectFailed, []byte("payload")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqID, status, payload, err := ParseResponse(BuildResponse(tt.reqID, tt.status, tt.payload))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if reqID != tt.reqID {
+				t.Errorf("ReqID 错误: %d", reqID)
+			}
+			if status != tt.status {
+				t.Errorf("Status 错误: %d", status)
+			}
+			if string(payload) != string(tt.payload) {
+				t.Errorf("Data 错误: %q", payload)
+			}
+		})
+	}
+}
+
+func TestParseResponseInvalid(t *testing.T) {
+	if _, _, _, err := ParseResponse([]byte{TypeData, 0, 0, 0, 1}); err == nil {
+		t.Error("过短的响应应该解析失败")
+	}
+	if _, _, _, err := ParseResponse([]byte{TypeConnect, 0, 0, 0, 1, StatusOK}); err == nil {
+		t.Error("非响应类型应该解析失败")
+	}
+}
+
+func TestParseConnectIPv6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	// Type(1) + ReqID(4) + Network(1) + AddrType(1) + IP(16) + Port(2)
+	data := make([]byte, 25)
+	data[0] = TypeConnect
+	binary.BigEndian.PutUint32(data[1:5], 1)
+	data[5] = NetworkTCP
+	data[6] = AddrIPv6
+	copy(data[7:23], ip.To16())
+	binary.BigEndian.PutUint16(data[23:25], 443)
+
+	req, err := ParseRequest(data)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if req.TargetAddr() != "[2001:db8::1]:443" {
+		t.Errorf("TargetAddr 错误: %s", req.TargetAddr())
+	}
+
+	// 可以被 Dial 使用的格式，拆分后得到原地址
+	host, port, err := net.SplitHostPort(req.TargetAddr())
+	if err != nil {
+		t.Fatalf("TargetAddr 无法拆分: %v", err)
+	}
+	if host != "2001:db8::1" || port != "443" {
+		t.Errorf("拆分结果错误: %s %s", host, port)
+	}
+}
+
+func TestTargetAddrZone(t *testing.T) {
+	req := &Request{Address: "fe80::1%eth0", Port: 80}
+	if req.TargetAddr() != "[fe80::1%eth0]:80" {
+		t.Errorf("TargetAddr 应保留 zone: %s", req.TargetAddr())
+	}
+}
+
+func TestParseRequestsBatch(t *testing.T) {
+	data := make([]byte, 5+5)
+	data[0] = TypeData
+	binary.BigEndian.PutUint32(data[1:5], 1)
+	copy(data[5:], "hello")
+
+	closeMsg := []byte{TypeClose, 0, 0, 0, 2}
+
+	reqs, err := ParseRequests(BuildBatch(data, closeMsg))
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("消息数量错误: %d", len(reqs))
+	}
+	if reqs[0].Type != TypeData || reqs[0].ReqID != 1 || string(reqs[0].Data) != "hello" {
+		t.Errorf("第一条消息错误: %+v", reqs[0])
+	}
+	if reqs[1].Type != TypeClose || reqs[1].ReqID != 2 {
+		t.Errorf("第二条消息错误: %+v", reqs[1])
+	}
+}
+
+func TestParseRequestsTruncated(t *testing.T) {
+	closeMsg := []byte{TypeClose, 0, 0, 0, 1}
+	batch := BuildBatch(closeMsg, closeMsg)
+
+	reqs, err := ParseRequests(batch[:len(batch)-2])
+	if err == nil {
+		t.Fatal("截断的消息应该报错")
+	}
+	if len(reqs) != 1 {
+		t.Errorf("应返回截断前已解析的消息: %d", len(reqs))
+	}
+
+	if _, err := ParseRequests(append(BuildBatch(closeMsg), 0x00)); err == nil {
+		t.Error("末尾多余字节应该报错")
+	}
+}
+
+func TestBuildConnectRoundTrip(t *testing.T) {
+	tests := []struct {
+		host string
+		addr string
+	}{
+		{"8.8.8.8", "8.8.8.8:443"},
+		{"2001:db8::1", "[2001:db8::1]:443"},
+		{"example.com", "example.com:443"},
+	}
+
+	for _, tt := range tests {
+		msg, err := BuildConnect(7, NetworkTCP, tt.host, 443, []byte("init"))
+		if err != nil {
+			t.Fatalf("构建失败 %s: %v", tt.host, err)
+		}
+		req, err := ParseRequest(msg)
+		if err != nil {
+			t.Fatalf("解析失败 %s: %v", tt.host, err)
+		}
+		if req.ReqID != 7 || req.TargetAddr() != tt.addr || string(req.Data) != "init" {
+			t.Errorf("往返结果错误: %+v", req)
+		}
+	}
+
+	if _, err := BuildConnect(1, NetworkTCP, strings.Repeat("a", 256), 80, nil); err == nil {
+		t.Error("过长的域名应该被拒绝")
+	}
+}
+
+func TestBuildConnectTimeout(t *testing.T) {
+	msg, err := BuildConnectTimeout(9, NetworkTCP, "example.com", 443, 1500*time.Millisecond, []byte("init"))
+	if err != nil {
+		t.Fatalf("构建失败: %v", err)
+	}
+	req, err := ParseRequest(msg)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if req.Network != NetworkTCP || req.ConnectTimeout != 1500*time.Millisecond ||
+		req.TargetAddr() != "example.com:443" || string(req.Data) != "init" {
+		t.Errorf("往返结果错误: %+v", req)
+	}
+
+	// 不带超时时格式与 BuildConnect 一致
+	plain, _ := BuildConnect(9, NetworkTCP, "example.com", 443, nil)
+	noTimeout, _ := BuildConnectTimeout(9, NetworkTCP, "example.com", 443, 0, nil)
+	if !bytes.Equal(plain, noTimeout) {
+		t.Error("超时为 0 时不应改变消息格式")
+	}
+
+	if _, err := BuildConnectTimeout(1, NetworkTCP, "example.com", 443, MaxConnectTimeout+time.Millisecond, nil); err == nil {
+		t.Error("超出范围的超时应该被拒绝")
+	}
+
+	// 置位了超时标志但数据不足
+	if _, err := ParseRequest([]byte{TypeConnect, 0, 0, 0, 1, NetworkTCP | NetworkFlagTimeout, 0x01, AddrIPv4}); err == nil {
+		t.Error("截断的超时字段应该被拒绝")
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	req, err := ParseRequest(BuildCloseReason(5, CloseReasonIdleTimeout))
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if req.Type != TypeClose || req.ReqID != 5 || req.CloseReason() != CloseReasonIdleTimeout {
+		t.Errorf("关闭原因错误: %+v", req)
+	}
+
+	// 不带原因的旧格式仍然有效
+	req, err = ParseRequest(BuildClose(5))
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if req.CloseReason() != CloseReasonNone {
+		t.Errorf("未携带原因时应为 CloseReasonNone: %d", req.CloseReason())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	msg, err := BuildResolve(9, "example.com")
+	if err != nil {
+		t.Fatalf("构建失败: %v", err)
+	}
+	req, err := ParseRequest(msg)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if req.Type != TypeResolve || req.ReqID != 9 || req.Address != "example.com" || req.Data != nil {
+		t.Errorf("Resolve 解析结果错误: %+v", req)
+	}
+	if _, err := BuildResolve(1, ""); err == nil {
+		t.Error("空域名应该被拒绝")
+	}
+	if _, err := ParseRequest([]byte{TypeResolve, 0, 0, 0, 1, 5, 'a'}); err == nil {
+		t.Error("截断的域名应该被拒绝")
+	}
+
+	ips := []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}
+	reqID, status, payload, err := ParseResponse(BuildResolveResp(9, StatusOK, ips))
+	if err != nil || reqID != 9 || status != StatusOK {
+		t.Fatalf("解析结果响应错误: %d %d %v", reqID, status, err)
+	}
+	got, err := ParseResolveAddrs(payload)
+	if err != nil || len(got) != 2 || !got[0].Equal(ips[0]) || !got[1].Equal(ips[1]) {
+		t.Errorf("地址列表错误: %v %v", got, err)
+	}
+	if _, err := ParseResolveAddrs([]byte{AddrIPv6, 1, 2}); err == nil {
+		t.Error("截断的地址应该返回错误")
+	}
+}
+
+func TestParseConnectEmptyDomain(t *testing.T) {
+	data := []byte{TypeConnect, 0, 0, 0, 1, NetworkTCP, AddrDomain, 0, 0, 80}
+	if _, err := ParseRequest(data); err == nil {
+		t.Error("空域名应该被拒绝")
+	}
+}
+
+func TestParseConnectRandom(t *testing.T) {
+	rng := mathrand.New(mathrand.NewSource(1))
+	addrTypes := []byte{AddrIPv4, AddrIPv6, AddrDomain, 0x00, 0xFF}
+
+	for i := 0; i < 20000; i++ {
+		data := make([]byte, 5+rng.Intn(300))
+		rng.Read(data)
+		data[0] = TypeConnect
+		if len(data) > 6 {
+			data[6] = addrTypes[rng.Intn(len(addrTypes))]
+		}
+
+		req, err := ParseRequest(data)
+		if err != nil {
+			continue
+		}
+
+		// 接受的消息重新构建后应解析出相同的结果
+		rebuilt, err := BuildConnectTimeout(req.ReqID, req.Network, req.Address, req.Port, req.ConnectTimeout, req.Data)
+		if err != nil {
+			t.Fatalf("已接受的消息无法重建: %x: %v", data, err)
+		}
+		again, err := ParseRequest(rebuilt)
+		if err != nil {
+			t.Fatalf("重建的消息被拒绝: %x: %v", rebuilt, err)
+		}
+		if again.ReqID != req.ReqID || again.Network != req.Network || again.Address != req.Address ||
+			again.Port != req.Port || string(again.Data) != string(req.Data) || again.ConnectTimeout != req.ConnectTimeout {
+			t.Fatalf("往返结果不一致: %+v != %+v", again, req)
+		}
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	for _, host := range []string{"1.2.3.4", "2001:db8::1", "example.com"} {
+		msg, _ := BuildConnect(1, NetworkTCP, host, 443, []byte("init"))
+		f.Add(msg)
+	}
+	f.Add(BuildData(2, []byte("payload")))
+	f.Add(BuildClose(3))
+	resolve, _ := BuildResolve(4, "example.com")
+	f.Add(resolve)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := ParseRequest(data)
+		if err != nil {
+			return
+		}
+		if req.ReqID != binary.BigEndian.Uint32(data[1:5]) {
+			t.Fatalf("ReqID 错误: %d", req.ReqID)
+		}
+		// Data 总是消息的尾部
+		if len(req.Data) > len(data)-5 || !bytes.HasSuffix(data, req.Data) {
+			t.Fatalf("Data 越界: %d/%d", len(req.Data), len(data))
+		}
+		if req.Type != TypeConnect {
+			return
+		}
+
+		rebuilt, err := BuildConnectTimeout(req.ReqID, req.Network, req.Address, req.Port, req.ConnectTimeout, req.Data)
+		if err != nil {
+			t.Fatalf("已接受的 Connect 无法重建: %v", err)
+		}
+		again, err := ParseRequest(rebuilt)
+		if err != nil {
+			t.Fatalf("重建的 Connect 被拒绝: %v", err)
+		}
+		if again.TargetAddr() != req.TargetAddr() || !bytes.Equal(again.Data, req.Data) ||
+			again.ConnectTimeout != req.ConnectTimeout {
+			t.Fatalf("往返结果不一致: %+v != %+v", again, req)
+		}
+	})
+}
@@ -4,10 +4,13 @@ package transport
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +19,8 @@ const (
 	MaxPacketSize    = 65535
 	ReadTimeout      = 5 * time.Minute
 	WriteTimeout     = 30 * time.Second
+	// FrameBodyTimeout 收到长度前缀后读完帧体的默认超时
+	FrameBodyTimeout = 30 * time.Second
 )
 
 // PacketHandler 数据包处理接口
@@ -23,51 +28,110 @@ type PacketHandler interface {
 	HandleConnection(ctx context.Context, conn net.Conn)
 }
 
+// ShutdownNotifier 可选接口：优雅停止开始时通知所有已连接的客户端
+type ShutdownNotifier interface {
+	NotifyShutdown()
+}
+
 // TCPServer TCP 服务器
 type TCPServer struct {
 	addr     string
 	listener net.Listener
 	handler  PacketHandler
-	logLevel int
+	logLevel atomic.Int32
+	noDelay  atomic.Bool
+	out      io.Writer
+
+	conns      sync.Map
+	stopCh     chan struct{}
+	listenOnce sync.Once
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+
+	activeConns atomic.Int64
+	totalConns  atomic.Int64
+}
 
-	conns  sync.Map
-	stopCh chan struct{}
-	wg     sync.WaitGroup
+// ServerStats 服务器统计信息
+type ServerStats struct {
+	ActiveConns int64 `json:"active_conns"`
+	TotalConns  int64 `json:"total_conns"`
 }
 
 // NewTCPServer 创建 TCP 服务器
 func NewTCPServer(addr string, handler PacketHandler, logLevel string) *TCPServer {
-	level := 1
+	s := &TCPServer{
+		addr:    addr,
+		handler: handler,
+		out:     os.Stdout,
+		stopCh:  make(chan struct{}),
+	}
+	s.SetLogLevel(logLevel)
+	s.noDelay.Store(true)
+	return s
+}
+
+// SetLogLevel 运行时修改日志级别
+func (s *TCPServer) SetLogLevel(logLevel string) {
+	level := int32(1)
 	switch logLevel {
 	case "debug":
 		level = 2
 	case "error":
 		level = 0
 	}
+	s.logLevel.Store(level)
+}
 
-	return &TCPServer{
-		addr:     addr,
-		handler:  handler,
-		logLevel: level,
-		stopCh:   make(chan struct{}),
-	}
+// SetNoDelay 设置新接受连接的 TCP_NODELAY，默认开启以降低延迟
+// 以大块传输为主时关闭可让 Nagle 合并小包、提高吞吐；只影响之后接受的连接
+func (s *TCPServer) SetNoDelay(enabled bool) {
+	s.noDelay.Store(enabled)
 }
 
 // Start 启动服务器
 func (s *TCPServer) Start(ctx context.Context) error {
+	select {
+	case <-s.stopCh:
+		return fmt.Errorf("TCP 服务器已停止")
+	default:
+	}
+
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("TCP 监听失败: %w", err)
 	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve 在已有的监听器上启动服务器，用于平滑重启时接管父进程交接的监听套接字
+func (s *TCPServer) Serve(ctx context.Context, listener net.Listener) error {
+	select {
+	case <-s.stopCh:
+		listener.Close()
+		return fmt.Errorf("TCP 服务器已停止")
+	default:
+	}
 	s.listener = listener
 
 	s.wg.Add(1)
 	go s.acceptLoop(ctx)
 
-	s.log(1, "TCP 服务器已启动: %s", s.addr)
+	s.log(1, "TCP 服务器已启动: %s", listener.Addr())
 	return nil
 }
 
+// ListenerFile 返回监听套接字的副本，可经 exec.Cmd.ExtraFiles 交给新进程
+// 新进程用 net.FileListener 恢复后与本进程共享同一个 accept 队列，
+// 本进程随后停止接受连接也不会丢弃排队中的连接。调用方负责关闭返回的文件
+func (s *TCPServer) ListenerFile() (*os.File, error) {
+	tcpListener, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("监听器不支持导出文件描述符")
+	}
+	return tcpListener.File()
+}
+
 // acceptLoop 接受连接循环
 func (s *TCPServer) acceptLoop(ctx context.Context) {
 	defer s.wg.Done()
@@ -91,6 +155,11 @@ func (s *TCPServer) acceptLoop(ctx context.Context) {
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
 				continue
 			}
+			// 监听器已关闭：Stop 可能在本循环检查 stopCh 之后才执行，
+			// 这属于正常停止，而非错误
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			select {
 			case <-s.stopCh:
 				return
@@ -102,12 +171,14 @@ func (s *TCPServer) acceptLoop(ctx context.Context) {
 
 		// 配置 TCP 连接
 		if tcpConn, ok := conn.(*net.TCPConn); ok {
-			_ = tcpConn.SetNoDelay(true)
+			_ = tcpConn.SetNoDelay(s.noDelay.Load())
 			_ = tcpConn.SetKeepAlive(true)
 			_ = tcpConn.SetKeepAlivePeriod(30 * time.Second)
 		}
 
 		s.conns.Store(conn, struct{}{})
+		s.activeConns.Add(1)
+		s.totalConns.Add(1)
 		s.log(2, "新连接: %s", conn.RemoteAddr())
 
 		s.wg.Add(1)
@@ -115,6 +186,7 @@ func (s *TCPServer) acceptLoop(ctx context.Context) {
 			defer s.wg.Done()
 			defer func() {
 				s.conns.Delete(c)
+				s.activeConns.Add(-1)
 				_ = c.Close()
 				s.log(2, "连接关闭: %s", c.RemoteAddr())
 			}()
@@ -123,39 +195,81 @@ func (s *TCPServer) acceptLoop(ctx context.Context) {
 	}
 }
 
-// Stop 停止服务器
+// Stop 停止服务器，可重复调用
 func (s *TCPServer) Stop() {
-	close(s.stopCh)
+	s.closeListener()
+
+	s.stopOnce.Do(func() {
+		// 关闭所有连接
+		s.conns.Range(func(key, _ interface{}) bool {
+			if conn, ok := key.(net.Conn); ok {
+				_ = conn.Close()
+			}
+			return true
+		})
+
+		s.wg.Wait()
+		s.log(1, "TCP 服务器已停止")
+	})
+}
+
+// StopGraceful 优雅停止：先停止接受新连接并通知客户端，
+// 等待现有连接在 timeout 内自行断开，之后强制关闭剩余连接
+func (s *TCPServer) StopGraceful(timeout time.Duration) {
+	s.closeListener()
 
-	if s.listener != nil {
-		_ = s.listener.Close()
+	if notifier, ok := s.handler.(ShutdownNotifier); ok {
+		notifier.NotifyShutdown()
 	}
 
-	// 关闭所有连接
-	s.conns.Range(func(key, _ interface{}) bool {
-		if conn, ok := key.(net.Conn); ok {
-			_ = conn.Close()
+	deadline := time.Now().Add(timeout)
+	for s.activeConns.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.Stop()
+}
+
+// closeListener 停止接受新连接
+func (s *TCPServer) closeListener() {
+	s.listenOnce.Do(func() {
+		close(s.stopCh)
+		if s.listener != nil {
+			_ = s.listener.Close()
 		}
-		return true
 	})
+}
 
-	s.wg.Wait()
-	s.log(1, "TCP 服务器已停止")
+// Addr 返回实际监听地址，未启动时返回 nil
+func (s *TCPServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stats 返回服务器统计信息
+func (s *TCPServer) Stats() ServerStats {
+	return ServerStats{
+		ActiveConns: s.activeConns.Load(),
+		TotalConns:  s.totalConns.Load(),
+	}
 }
 
 func (s *TCPServer) log(level int, format string, args ...interface{}) {
-	if level > s.logLevel {
+	if int32(level) > s.logLevel.Load() {
 		return
 	}
 	prefix := map[int]string{0: "[ERROR]", 1: "[INFO]", 2: "[DEBUG]"}[level]
-	fmt.Printf("%s %s %s\n", prefix, time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+	fmt.Fprintf(s.out, "%s %s %s\n", prefix, time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
 }
 
 // FrameReader 帧读取器 - 用于读取长度前缀的帧
 type FrameReader struct {
-	conn    net.Conn
-	buf     []byte
-	timeout time.Duration
+	conn        net.Conn
+	buf         []byte
+	timeout     time.Duration
+	bodyTimeout time.Duration
 }
 
 // NewFrameReader 创建帧读取器
@@ -167,6 +281,18 @@ func NewFrameReader(conn net.Conn, timeout time.Duration) *FrameReader {
 	}
 }
 
+// SetTimeout 修改等待下一帧 (长度前缀) 的读超时，0 表示不设超时
+// 用于在连接的不同阶段切换超时而不重新分配读取缓冲
+func (r *FrameReader) SetTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// SetBodyTimeout 设置收到长度前缀后读完帧体的超时，0 表示沿用整体读超时
+// 对端发出合法长度后停止发送时，不必等到空闲读超时才断开
+func (r *FrameReader) SetBodyTimeout(d time.Duration) {
+	r.bodyTimeout = d
+}
+
 // ReadFrame 读取一个完整的帧
 // 帧格式: [长度(2字节)] [数据(N字节)]
 func (r *FrameReader) ReadFrame() ([]byte, error) {
@@ -189,6 +315,7 @@ func (r *FrameReader) ReadFrame() ([]byte, error) {
 	}
 
 	// 读取数据
+	r.startBody()
 	data := r.buf[LengthPrefixSize : LengthPrefixSize+length]
 	if _, err := io.ReadFull(r.conn, data); err != nil {
 		return nil, err
@@ -200,12 +327,47 @@ func (r *FrameReader) ReadFrame() ([]byte, error) {
 	return result, nil
 }
 
+// ReadFrameInto 读取一个完整的帧到 dst，返回帧长度
+// 与 ReadFrame 不同，不分配新内存；dst 的内容在下一次读取时会被覆盖
+func (r *FrameReader) ReadFrameInto(dst []byte) (int, error) {
+	if r.timeout > 0 {
+		_ = r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+
+	lengthBuf := r.buf[:LengthPrefixSize]
+	if _, err := io.ReadFull(r.conn, lengthBuf); err != nil {
+		return 0, err
+	}
+
+	length := int(binary.BigEndian.Uint16(lengthBuf))
+	if length == 0 {
+		return 0, fmt.Errorf("无效的帧长度: 0")
+	}
+	if length > len(dst) {
+		return 0, fmt.Errorf("缓冲区不足: %d > %d: %w", length, len(dst), io.ErrShortBuffer)
+	}
+
+	r.startBody()
+	if _, err := io.ReadFull(r.conn, dst[:length]); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// startBody 长度前缀已读到，为帧体设置更短的读超时
+func (r *FrameReader) startBody() {
+	if r.bodyTimeout > 0 {
+		_ = r.conn.SetReadDeadline(time.Now().Add(r.bodyTimeout))
+	}
+}
+
 // FrameWriter 帧写入器 - 用于写入长度前缀的帧
+// 多个代理连接共用一个 FrameWriter 时，按连接 ID 轮流写入 (见 WriteFrameFor)
 type FrameWriter struct {
 	conn    net.Conn
 	buf     []byte
 	timeout time.Duration
-	mu      sync.Mutex
+	lock    fairLock
 }
 
 // NewFrameWriter 创建帧写入器
@@ -217,16 +379,32 @@ func NewFrameWriter(conn net.Conn, timeout time.Duration) *FrameWriter {
 	}
 }
 
-// WriteFrame 写入一个帧
+// WriteFrame 写入一个不属于任何代理连接的控制帧 (连接响应、关闭通知等)
+// 控制帧优先于所有连接的数据帧，最多等待正在写入的一个帧
 // 帧格式: [长度(2字节)] [数据(N字节)]
 func (w *FrameWriter) WriteFrame(data []byte) error {
 	if len(data) > MaxPacketSize {
 		return fmt.Errorf("数据太大: %d > %d", len(data), MaxPacketSize)
 	}
+	w.lock.lockPriority()
+	defer w.lock.unlock()
+	return w.write(data)
+}
 
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// WriteFrameFor 代表 id 写入一个帧
+// 有多个 id 等待写入时按轮转顺序交替进行，持续写大块数据的 id
+// 不会让其他 id 的小帧一直排在后面
+func (w *FrameWriter) WriteFrameFor(id uint32, data []byte) error {
+	if len(data) > MaxPacketSize {
+		return fmt.Errorf("数据太大: %d > %d", len(data), MaxPacketSize)
+	}
+	w.lock.lock(id)
+	defer w.lock.unlock()
+	return w.write(data)
+}
 
+// write 写入一个帧，调用方需持有 w.lock
+func (w *FrameWriter) write(data []byte) error {
 	if w.timeout > 0 {
 		_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
 	}
@@ -240,3 +418,79 @@ func (w *FrameWriter) WriteFrame(data []byte) error {
 	_, err := w.conn.Write(w.buf[:total])
 	return err
 }
+
+// fairLock 按 id 轮转交接的互斥锁
+// sync.Mutex 允许刚释放锁的 goroutine 立即重新抢到锁，连续写大帧的连接
+// 会让其他连接等待；fairLock 释放时直接把锁交给下一个等待的 id
+type fairLock struct {
+	mu       sync.Mutex
+	busy     bool
+	priority []chan struct{}            // 控制帧的等待者，先于所有 id
+	waiters  map[uint32][]chan struct{} // 每个 id 的等待者，先来先得
+	ring     []uint32                   // 有等待者的 id，按轮转顺序
+}
+
+// lockPriority 以控制帧的身份加锁，释放时优先交给控制帧，不参与 id 的轮转
+func (l *fairLock) lockPriority() {
+	l.mu.Lock()
+	if !l.busy {
+		l.busy = true
+		l.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	l.priority = append(l.priority, ch)
+	l.mu.Unlock()
+	<-ch
+}
+
+func (l *fairLock) lock(id uint32) {
+	l.mu.Lock()
+	if !l.busy {
+		l.busy = true
+		l.mu.Unlock()
+		return
+	}
+	if l.waiters == nil {
+		l.waiters = make(map[uint32][]chan struct{})
+	}
+	ch := make(chan struct{})
+	if len(l.waiters[id]) == 0 {
+		l.ring = append(l.ring, id)
+	}
+	l.waiters[id] = append(l.waiters[id], ch)
+	l.mu.Unlock()
+
+	// 被唤醒时锁已经交给本 goroutine
+	<-ch
+}
+
+func (l *fairLock) unlock() {
+	l.mu.Lock()
+	if len(l.priority) > 0 {
+		next := l.priority[0]
+		l.priority = l.priority[1:]
+		l.mu.Unlock()
+		close(next)
+		return
+	}
+	if len(l.ring) == 0 {
+		l.busy = false
+		l.mu.Unlock()
+		return
+	}
+
+	id := l.ring[0]
+	l.ring = l.ring[1:]
+	queue := l.waiters[id]
+	next := queue[0]
+	if len(queue) > 1 {
+		// 同一 id 的后续等待者排到队尾
+		l.waiters[id] = queue[1:]
+		l.ring = append(l.ring, id)
+	} else {
+		delete(l.waiters, id)
+	}
+	l.mu.Unlock()
+	close(next)
+}
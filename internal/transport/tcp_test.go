@@ -0,0 +1,369 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer 并发安全的日志缓冲
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type nopHandler struct{}
+
+func (nopHandler) HandleConnection(ctx context.Context, conn net.Conn) {}
+
+func TestStartStopRace(t *testing.T) {
+	out := &syncBuffer{}
+
+	for i := 0; i < 50; i++ {
+		srv := NewTCPServer("127.0.0.1:0", nopHandler{}, "debug")
+		srv.out = out
+
+		if err := srv.Start(context.Background()); err != nil {
+			t.Fatalf("启动失败: %v", err)
+		}
+		srv.Stop()
+		srv.Stop()
+	}
+
+	if log := out.String(); strings.Contains(log, "[ERROR]") || strings.Contains(log, "Accept 错误") {
+		t.Errorf("停止过程不应产生错误日志:\n%s", log)
+	}
+}
+
+func TestStartAfterStop(t *testing.T) {
+	srv := NewTCPServer("127.0.0.1:0", nopHandler{}, "error")
+	srv.Stop()
+	if err := srv.Start(context.Background()); err == nil {
+		t.Error("停止后再启动应该失败")
+	}
+}
+
+// loopConn 循环返回同一段数据的连接，用于基准测试
+type loopConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	n := copy(b, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+func (c *loopConn) SetReadDeadline(t time.Time) error { return nil }
+
+func newLoopConn(payloadSize int) *loopConn {
+	frame := make([]byte, LengthPrefixSize+payloadSize)
+	binary.BigEndian.PutUint16(frame, uint16(payloadSize))
+	return &loopConn{data: frame}
+}
+
+func TestReadFrameInto(t *testing.T) {
+	r := NewFrameReader(newLoopConn(100), 0)
+
+	dst := make([]byte, MaxPacketSize)
+	n, err := r.ReadFrameInto(dst)
+	if err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	if n != 100 {
+		t.Errorf("帧长度错误: %d", n)
+	}
+
+	if _, err := r.ReadFrameInto(make([]byte, 10)); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("缓冲区不足应返回 ErrShortBuffer: %v", err)
+	}
+}
+
+func TestFrameBodyTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := NewFrameReader(server, time.Minute)
+	r.SetBodyTimeout(100 * time.Millisecond)
+
+	// 只发长度前缀，不发帧体
+	go client.Write([]byte{0, 100})
+
+	start := time.Now()
+	_, err := r.ReadFrameInto(make([]byte, MaxPacketSize))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("帧体未到达应超时: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("应在帧体超时内返回，而非整体读超时: %v", elapsed)
+	}
+}
+
+func TestFrameSetTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 连接建立后切换为较短的超时，无需重新创建读取器
+	r := NewFrameReader(server, time.Minute)
+	r.SetTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := r.ReadFrameInto(make([]byte, MaxPacketSize))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("没有数据时应超时: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("应使用新设置的超时: %v", elapsed)
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	r := NewFrameReader(newLoopConn(1400), 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFrameInto(b *testing.B) {
+	r := NewFrameReader(newLoopConn(1400), 0)
+	dst := make([]byte, MaxPacketSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadFrameInto(dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	out := &syncBuffer{}
+	srv := NewTCPServer("127.0.0.1:0", nopHandler{}, "info")
+	srv.out = out
+
+	srv.log(2, "before")
+	if strings.Contains(out.String(), "before") {
+		t.Fatal("info 级别不应输出 debug 日志")
+	}
+
+	srv.SetLogLevel("debug")
+	srv.log(2, "after")
+	if !strings.Contains(out.String(), "[DEBUG]") || !strings.Contains(out.String(), "after") {
+		t.Errorf("切换到 debug 后应输出 debug 日志: %q", out.String())
+	}
+}
+
+// connHandler 把接受的连接交给测试检查
+type connHandler chan net.Conn
+
+func (h connHandler) HandleConnection(ctx context.Context, conn net.Conn) {
+	h <- conn
+	<-ctx.Done()
+}
+
+// tcpNoDelay 读取连接实际的 TCP_NODELAY 设置
+func tcpNoDelay(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("获取 socket 失败: %v", err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatalf("读取 TCP_NODELAY 失败: %v", err)
+	}
+	return v != 0
+}
+
+func TestSetNoDelay(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		conns := make(connHandler, 1)
+		srv := NewTCPServer("127.0.0.1:0", conns, "error")
+		srv.SetNoDelay(enabled)
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := srv.Start(ctx); err != nil {
+			t.Fatalf("启动失败: %v", err)
+		}
+
+		client, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatalf("连接失败: %v", err)
+		}
+		if got := tcpNoDelay(t, <-conns); got != enabled {
+			t.Errorf("TCP_NODELAY 应为 %v，实际 %v", enabled, got)
+		}
+
+		client.Close()
+		cancel()
+		srv.Stop()
+	}
+}
+
+func TestWriteFrameForFairness(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 慢速读取端，统计已收到的大帧数量
+	var bulkSeen atomic.Int64
+	go func() {
+		reader := NewFrameReader(server, 0)
+		for {
+			frame, err := reader.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(frame) > 1024 {
+				bulkSeen.Add(1)
+				time.Sleep(200 * time.Microsecond)
+			}
+		}
+	}()
+
+	// 多个连接持续写大帧；连接 ID 由客户端选择，0 也是合法的 ID
+	bulkIDs := []uint32{0, 1, 3, 4}
+	writer := NewFrameWriter(client, 0)
+	stop := make(chan struct{})
+	var bulkWriters sync.WaitGroup
+	for _, id := range bulkIDs {
+		bulkWriters.Add(1)
+		go func() {
+			defer bulkWriters.Done()
+			bulk := make([]byte, 32*1024)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := writer.WriteFrameFor(id, bulk); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// 控制帧最多等待正在写的一个大帧；交互式连接的小帧最多再等每个大流量连接各一个
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond)
+		before := bulkSeen.Load()
+		if err := writer.WriteFrame([]byte("ctrl")); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		if waited := bulkSeen.Load() - before; waited > 2 {
+			t.Errorf("控制帧等待了 %d 个大帧", waited)
+		}
+
+		time.Sleep(time.Millisecond)
+		before = bulkSeen.Load()
+		if err := writer.WriteFrameFor(2, []byte("ping")); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		if waited := bulkSeen.Load() - before; waited > int64(len(bulkIDs))+1 {
+			t.Errorf("小帧等待了 %d 个大帧", waited)
+		}
+	}
+	close(stop)
+	bulkWriters.Wait()
+
+	if bulkSeen.Load() == 0 {
+		t.Error("大帧没有被写入")
+	}
+}
+
+// nameHandler 向每个连接写入服务器名后关闭，用于区分连接由哪个服务器接受
+type nameHandler byte
+
+func (h nameHandler) HandleConnection(ctx context.Context, conn net.Conn) {
+	conn.Write([]byte{byte(h)})
+}
+
+func TestListenerHandover(t *testing.T) {
+	old := NewTCPServer("127.0.0.1:0", nameHandler('o'), "error")
+	if err := old.Start(context.Background()); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer old.Stop()
+	addr := old.Addr().String()
+
+	// 新服务器接管同一个监听套接字 (平滑重启时由新进程完成)
+	f, err := old.ListenerFile()
+	if err != nil {
+		t.Fatalf("导出监听套接字失败: %v", err)
+	}
+	listener, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("恢复监听器失败: %v", err)
+	}
+	successor := NewTCPServer("", nameHandler('n'), "error")
+	if err := successor.Serve(context.Background(), listener); err != nil {
+		t.Fatalf("接管失败: %v", err)
+	}
+	defer successor.Stop()
+
+	// 旧服务器停止期间持续建立连接，每个连接都应被某个服务器接受
+	var stopped atomic.Bool
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		old.StopGraceful(time.Second)
+		stopped.Store(true)
+	}()
+	afterStop := 0
+	for i := 0; afterStop < 20; i++ {
+		wasStopped := stopped.Load()
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			t.Fatalf("第 %d 次连接失败: %v", i, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		name := make([]byte, 1)
+		_, err = io.ReadFull(conn, name)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("第 %d 个连接没有被接受: %v", i, err)
+		}
+		if wasStopped {
+			if name[0] != 'n' {
+				t.Fatalf("旧服务器停止后仍接受了连接")
+			}
+			afterStop++
+		}
+	}
+}